@@ -29,6 +29,7 @@ func main() {
 	cmds := make(chan monmq.Command)
 
 	a = monmq.NewAgent("amqp://amqp_broker:5672", "mon-exchange", name)
+	a.DrainTimeout = 30 * time.Second
 	a.HardShutdownFunc = func(data []byte) ([]byte, error) {
 		cmds <- monmq.HardShutdown
 		return nil, nil
@@ -51,7 +52,7 @@ func main() {
 
 	s := rpcmq.NewServer("amqp://amqp_broker:5672", "rcp-queue",
 		"rpc-exchange", "direct")
-	if err := s.Register("toUpper", toUpper); err != nil {
+	if err := s.Register("toUpper", a.Wrap(toUpper)); err != nil {
 		log.Fatalf("Register: %v", err)
 	}
 	if err := s.Init(); err != nil {
@@ -66,8 +67,12 @@ loop:
 			log.Println("Hard shutdown...")
 			break loop
 		case monmq.SoftShutdown:
-			log.Println("Soft shutdown...")
+			log.Println("Soft shutdown, draining...")
+			// Stop accepting new work and wait for the running
+			// tasks to finish.
 			s.Shutdown()
+			<-a.Drained()
+			log.Println("Drained")
 			a.Shutdown()
 			break loop
 		case monmq.Pause:
@@ -91,9 +96,6 @@ loop:
 }
 
 func toUpper(id string, data []byte) ([]byte, error) {
-	a.RegisterTask(id)
-	defer a.RemoveTask(id)
-
 	log.Printf("Received (%v): toUpper(%v)\n", id, string(data))
 	time.Sleep(5 * time.Second)
 	return []byte(strings.ToUpper(string(data))), nil
@@ -5,34 +5,160 @@
 package monmq
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/jroimartin/rpcmq"
 )
 
 // The type CommandFunction declares the signature of the methods that can be
-// registered by an Agent. The data parameter contains auxiliary data.
+// registered by an Agent. The data parameter contains the raw invocation: the
+// command byte followed by the target (the name of the agent) and, if the
+// supervisor sent any arguments (see Supervisor.InvokeArgs), a '|' and the
+// arguments, which can be extracted with InvocationArgs.
 type CommandFunction func(data []byte) ([]byte, error)
 
 // An Agent is responsible for sending its status when a supervisor on the same
 // exchange asks for it. It also executes the control operations requested by
 // the supervisors.
 type Agent struct {
+	uri    string
 	s      *rpcmq.Server
+	pc     *rpcmq.Client
+	done   chan bool
+	stop   sync.Once
 	status Status
 
-	mu sync.RWMutex
+	mu      sync.RWMutex
+	tasks   map[string]*task     // registered tasks indexed by id
+	history map[uint64][]byte    // sent snapshots indexed by sequence number
+	pushed  uint64               // sequence number of the last pushed update
+	seen    map[string]time.Time // ids of the received commands
+
+	drained chan struct{} // closed when the drain completes
+	wake    chan struct{} // notifies changes to the drain goroutine
+	changed chan struct{} // closed when the state changes
 
 	// TLSConfig allows to configure the TLS parameters used to connect to
 	// the broker via amqps.
 	TLSConfig *tls.Config
 
+	// PushInterval is the time between two status updates pushed by the
+	// agent to StatusExchange. A value lower than or equal to zero
+	// disables push mode, so the agent only replies to the GetStatus
+	// requests sent by the supervisors.
+	PushInterval time.Duration
+
+	// StatusExchange is the name of the exchange where the agent pushes
+	// its status.
+	StatusExchange string
+
+	// DeltaUpdates enables delta encoding. When it is true, the agent only
+	// sends the fields that changed since the last update acknowledged by
+	// the supervisor, or since the last pushed update in push mode.
+	DeltaUpdates bool
+
+	// SnapshotEvery is the number of updates between two full snapshots
+	// when DeltaUpdates is enabled. Default: 10.
+	SnapshotEvery int
+
+	// TrustedKeys are the keys used to verify the signature of the
+	// commands. If it is empty, signatures are not required.
+	TrustedKeys []Verifier
+
+	// TrustedCAs, if not nil, allows commands signed with a certificate
+	// (see CertSigner) issued by one of these CAs. The identity of the
+	// supervisor is derived from the certificate.
+	TrustedCAs *x509.CertPool
+
+	// SupervisorOU is the organizational unit that the subject of the
+	// certificates used to sign commands must have, so the certificates
+	// of the agents, usually issued by the same CAs, cannot be used to
+	// command the fleet. If it is empty, any certificate issued by
+	// TrustedCAs is accepted, which is only allowed along with an
+	// Authorizer. Default: "monmq-supervisor".
+	SupervisorOU string
+
+	// AllowUnsignedStatus allows unsigned GetStatus commands when
+	// TrustedKeys is not empty.
+	AllowUnsignedStatus bool
+
+	// MaxCommandAge is the maximum amount of time since a command was
+	// issued for it to be executed, whatever its TTL. The ids of the
+	// received commands are remembered during this time in order to
+	// refuse replays. A value lower than or equal to zero disables the
+	// limit, so ids are remembered until the command expires. Default:
+	// 10m.
+	MaxCommandAge time.Duration
+
+	// ClockSkew is the tolerated difference between the clocks of the
+	// supervisors and the agent when checking the expiration of the
+	// commands. Default: 30s.
+	ClockSkew time.Duration
+
+	// Policy, if not nil, is enforced on the commands sent to the agent
+	// after checking the Authorizer. Refused commands are replied with a
+	// Refusal.
+	Policy *CommandPolicy
+
+	// Signer, if not nil, is used to sign the replies and the pushed
+	// status, so the supervisors can authenticate the agent. When using
+	// a CertSigner, the identity of its certificate must be the name of
+	// the agent.
+	Signer Signer
+
+	// Keyring, if not nil, is used to decrypt the commands sent by the
+	// supervisors, encrypt the replies and the pushed status. Plaintext
+	// commands are refused unless AllowPlaintext is true. Commands that
+	// cannot be decrypted are ignored, as their target is unknown.
+	Keyring *Keyring
+
+	// AllowPlaintext allows plaintext commands when Keyring is not nil,
+	// which is useful while the supervisors are being configured. The
+	// replies to plaintext commands are not encrypted.
+	AllowPlaintext bool
+
+	// Authorizer, if not nil, decides which commands can be invoked by
+	// every identity. Identities are only established for the commands
+	// signed with one of the TrustedKeys.
+	Authorizer *Authorizer
+
+	// Audit, if not nil, records the commands rejected, executed or
+	// failed by the agent. Successful GetStatus commands are not recorded.
+	Audit AuditSink
+
+	// DrainTimeout is the maximum amount of time the agent waits for its
+	// registered tasks to finish after a SoftShutdown command, before
+	// changing to the state Stopped. A value lower than or equal to zero
+	// means that there is no limit. See Drained.
+	DrainTimeout time.Duration
+
+	// HoldWhenPaused makes the functions wrapped by Wrap wait until the
+	// agent is resumed instead of rejecting the new tasks while it is
+	// paused.
+	HoldWhenPaused bool
+
+	// TaskDoneFunc, if not nil, is called after every task executed by a
+	// function wrapped by Wrap.
+	TaskDoneFunc TaskDoneFunc
+
+	// Labels are arbitrary key/value pairs reported to the supervisors
+	// (e.g. role or datacenter). They must be set before calling Init.
+	Labels map[string]string
+
+	// TransitionFunc, if not nil, is called after every change of the
+	// lifecycle state of the agent.
+	TransitionFunc TransitionFunc
+
 	// SoftShutdownFunc will be called when a supervisor invokes the
-	// command SoftShutdown.
+	// command SoftShutdown. It should stop accepting new work. Then the
+	// agent drains, waiting for the registered tasks to finish (see
+	// DrainTimeout and Drained).
 	SoftShutdownFunc CommandFunction
 
 	// HardShutdownFunc will be called when a supervisor invokes the
@@ -51,19 +177,57 @@ type Agent struct {
 	// CustomCmd.
 	CustomFunc CommandFunction
 
+	// KillGracePeriod is the amount of time the agent waits for a task to
+	// return after cancelling its context when a supervisor invokes the
+	// command KillTask. Other commands are not handled meanwhile. A value
+	// lower than or equal to zero makes the agent call KillTaskFunc right
+	// after cancelling the context, which suits the tasks that do not use
+	// their context. Default: 5s.
+	KillGracePeriod time.Duration
+
 	// KillTaskFunc will be called when a supervisor invokes the command
-	// KillTask.
-	KillTaskFunc CommandFunction
+	// KillTask and the task does not return within KillGracePeriod after
+	// cancelling its context. It receives the id of the task and the kill
+	// reason.
+	KillTaskFunc KillTaskFunction
+
+	// Logs keeps the recent log lines of the agent, which are returned
+	// when a supervisor invokes the command GetLogs. If it is nil, GetLogs
+	// fails with ErrNoLogBuffer.
+	Logs *LogBuffer
+
+	// LogChunkSize is the approximate maximum size in bytes of the replies
+	// to GetLogs. Bigger replies are split in chunks (see LogChunk).
+	// Default: 64KiB.
+	LogChunkSize int
 }
 
 // NewAgent returns a reference to an Agent object. The paremeter uri is the
 // network address of the broker and exchange is the name of exchange that will
 // be created.
 func NewAgent(uri, exchange, name string) *Agent {
-	a := &Agent{}
+	a := &Agent{
+		uri:           uri,
+		done:          make(chan bool),
+		tasks:         make(map[string]*task),
+		history:       make(map[uint64][]byte),
+		seen:          make(map[string]time.Time),
+		drained:       make(chan struct{}),
+		wake:          make(chan struct{}, 1),
+		changed:       make(chan struct{}),
+		SnapshotEvery: 10,
+		MaxCommandAge: 10 * time.Minute,
+		ClockSkew:     30 * time.Second,
+		SupervisorOU:  "monmq-supervisor",
+
+		KillGracePeriod: 5 * time.Second,
+		LogChunkSize:    64 << 10,
+	}
 	a.s = rpcmq.NewServer(uri, "", exchange, "fanout")
 	a.s.Parallel = 1
 	a.status.Name = name
+	a.status.State = Starting
+	a.status.StateSince = time.Now()
 	return a
 }
 
@@ -71,29 +235,137 @@ func NewAgent(uri, exchange, name string) *Agent {
 // broker, creating a channel and the exchange that will be used under the hood.
 func (a *Agent) Init() error {
 	a.s.TLSConfig = a.TLSConfig
+	a.status.Labels = a.Labels
 	if err := a.s.Register("invoke", a.invoke); err != nil {
 		return err
 	}
 	if err := a.s.Init(); err != nil {
 		return err
 	}
-	a.status.Running = true
-	return nil
+	if a.PushInterval > 0 {
+		a.pc = rpcmq.NewClient(a.uri, "", a.StatusExchange+"."+a.status.Name,
+			a.StatusExchange, "fanout")
+		a.pc.TLSConfig = a.TLSConfig
+		if err := a.pc.Init(); err != nil {
+			return err
+		}
+		go a.pushStatus()
+	}
+	_, err := a.transition([]State{Starting}, Running)
+	return err
+}
+
+func (a *Agent) pushStatus() {
+	// Supervisors do not reply with any meaningful data.
+	go func() {
+		for range a.pc.Results() {
+		}
+	}()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-time.After(a.PushInterval):
+			data, seq, err := a.pushUpdate()
+			if err != nil {
+				logf("push status: %v", err)
+				continue
+			}
+			if _, err := a.pc.Call("status", data, a.PushInterval); err != nil {
+				logf("push status: %v", err)
+				continue
+			}
+			a.mu.Lock()
+			a.pushed = seq
+			a.mu.Unlock()
+		}
+	}
+}
+
+// pushUpdate returns the message pushed to StatusExchange, which contains
+// the changes since the last pushed update, and the sequence number of the
+// new update.
+func (a *Agent) pushUpdate() ([]byte, uint64, error) {
+	a.mu.RLock()
+	base := a.pushed
+	a.mu.RUnlock()
+	b, seq, err := a.statusUpdate(base)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Pushed status do not answer any request, so they are signed with a
+	// random id.
+	id, err := newCommandID()
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := a.encodeReply(id, append([]byte{byte(GetStatus)}, b...), a.Keyring != nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, seq, nil
 }
 
 // Shutdown shuts down the agent gracefully. Using this method will ensure that
 // all requests sent by the supervisors to the agent will be received by the
 // latter.
+// Calling Shutdown more than once has no effect.
 func (a *Agent) Shutdown() {
-	a.s.Shutdown()
+	a.stop.Do(func() {
+		if a.State() != Stopped {
+			a.restore(Stopped)
+		}
+		close(a.done)
+		if a.pc != nil {
+			a.pc.Shutdown()
+		}
+		a.s.Shutdown()
+	})
 }
 
-// RegisterTask adds a task to the list of tasks handled by the agent.
-func (a *Agent) RegisterTask(id string) {
+// Name returns the name of the agent, which is the target of the commands
+// sent to it.
+func (a *Agent) Name() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.status.Name
+}
+
+// RegisterTask adds a task to the list of tasks handled by the agent. It
+// returns a context that is cancelled when a supervisor invokes KillTask on
+// the task, with the reason of the kill as cause (see ErrTaskKilled), or when
+// the task is removed. If the task is already registered, its context is
+// returned.
+func (a *Agent) RegisterTask(id string) context.Context {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	if t, ok := a.tasks[id]; ok {
+		return t.ctx
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	a.tasks[id] = &task{ctx: ctx, cancel: cancel, done: make(chan struct{})}
 	a.status.Tasks = append(a.status.Tasks, id)
+	if a.status.TaskStart == nil {
+		a.status.TaskStart = make(map[string]time.Time)
+	}
+	a.status.TaskStart[id] = time.Now()
+	return ctx
+}
+
+// TaskContext returns the context of a registered task (see RegisterTask). If
+// the task is not registered, a cancelled context is returned.
+func (a *Agent) TaskContext(id string) context.Context {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if t, ok := a.tasks[id]; ok {
+		return t.ctx
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrTaskNotFound)
+	return ctx
 }
 
 // RemoveTask removes a task from the list of tasks handled by the agent.
@@ -109,67 +381,318 @@ func (a *Agent) RemoveTask(id string) error {
 		}
 	}
 	if idx == -1 {
-		return errors.New("task not found")
+		return ErrTaskNotFound
 	}
 	a.status.Tasks = append(a.status.Tasks[:idx], a.status.Tasks[idx+1:]...)
+	delete(a.status.TaskStart, id)
+	if t, ok := a.tasks[id]; ok {
+		t.cancel(nil)
+		close(t.done)
+		delete(a.tasks, id)
+	}
+	if a.status.Drain != nil {
+		a.status.Drain.Remaining = len(a.status.Tasks)
+	}
+	a.notify()
 	return nil
 }
 
+// SetMetric sets the value of a custom metric reported to the supervisors.
+func (a *Agent) SetMetric(name string, value float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.setMetric(name, value)
+}
+
+// setMetric sets the value of a custom metric. The caller must hold a.mu.
+func (a *Agent) setMetric(name string, value float64) {
+	if a.status.Metrics == nil {
+		a.status.Metrics = make(map[string]float64)
+	}
+	a.status.Metrics[name] = value
+}
+
+// DeleteMetric removes a custom metric.
+func (a *Agent) DeleteMetric(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.status.Metrics, name)
+}
+
 func (a *Agent) invoke(id string, data []byte) ([]byte, error) {
 	a.mu.RLock()
 	name := a.status.Name
-	running := a.status.Running
 	a.mu.RUnlock()
 
+	encrypted := isSealed(data)
+	if encrypted {
+		var err error
+		if data, err = a.openRequest(data); err != nil {
+			// The target of the command is unknown, so the
+			// agent does not reply. Otherwise, every agent
+			// without the key would reply with an error to the
+			// commands sent to the others.
+			logf("ignored command: %v", err)
+			return nil, nil
+		}
+	}
+	req, err := decodeRequest(data)
+	if err != nil {
+		return nil, err
+	}
+
 	var f CommandFunction
-	cmd, aux := Command(data[0]), data[1:]
+	cmd, target, args := req.Cmd, req.Target, req.Args
+	// The functions registered by the user receive the raw invocation,
+	// while the internal ones only need the arguments.
+	in := encodeInvocation(cmd, target, args)
 	switch {
 	case cmd == GetStatus:
-		f = a.getStatus
-	case name == string(aux) && cmd == SoftShutdown:
+		f, in = a.getStatus, args
+	case name == target && cmd == SoftShutdown:
 		f = a.SoftShutdownFunc
-		running = false
-	case name == string(aux) && cmd == HardShutdown:
+	case name == target && cmd == HardShutdown:
 		f = a.HardShutdownFunc
-		running = false
-	case name == string(aux) && cmd == Pause:
+	case name == target && cmd == Pause:
 		f = a.PauseFunc
-		running = false
-	case name == string(aux) && cmd == Resume:
+	case name == target && cmd == Resume:
 		f = a.ResumeFunc
-		running = true
-	case name == string(aux) && cmd == CustomCmd:
+	case name == target && cmd == CustomCmd:
 		f = a.CustomFunc
-	case a.ownsTask(string(aux)) && cmd == KillTask:
-		f = a.KillTaskFunc
+	case name == target && cmd == GetLogs:
+		f, in = a.getLogs, args
+	case a.ownsTask(target) && cmd == KillTask:
+		f, in = func(data []byte) ([]byte, error) {
+			return a.killTask(target, data)
+		}, args
 	}
 	if f == nil {
-		// The command is not for this agent
+		// The command is not for this agent, so it is not
+		// authenticated nor audited.
 		return nil, nil
 	}
-	b, err := f(data)
+
+	rec := AuditRecord{
+		ID:      id,
+		Agent:   name,
+		Command: cmd.String(),
+		Target:  target,
+		Args:    args,
+	}
+	var identity string
+	if !encrypted && a.Keyring != nil && !a.AllowPlaintext {
+		err = ErrNotEncrypted
+	}
+	if err == nil {
+		identity, err = a.authenticate(req)
+	}
+	if err == nil {
+		err = a.checkReplay(req)
+	}
+	if err != nil {
+		logf("rejected %v command: %v", cmd, err)
+		rec.Event, rec.Error = AuditRejected, err.Error()
+		audit(a.Audit, rec)
+		return nil, fmt.Errorf("agent %s: %v", name, err)
+	}
+	rec.Issuer = identity
+	if a.Authorizer != nil {
+		// Roles are granted on agents, whatever the target of
+		// the command (e.g. a task).
+		if err := a.Authorizer.Authorize(identity, cmd, name); err != nil {
+			logf("rejected %v command: %v", cmd, err)
+			rec.Event, rec.Error = AuditRejected, err.Error()
+			audit(a.Audit, rec)
+			return nil, fmt.Errorf("agent %s: %v", name, err)
+		}
+	}
+	if a.Policy != nil {
+		if refusal := a.Policy.check(identity, req); refusal != nil {
+			refusal.Agent = name
+			logf("refused %v command: %s", cmd, refusal.Reason)
+			rec.Event, rec.Error = AuditRejected, refusal.Error()
+			audit(a.Audit, rec)
+			return nil, fmt.Errorf("agent %s: %s", name, refusal.encode())
+		}
+	}
+	finish, err := a.beginCommand(cmd)
 	if err != nil {
+		logf("rejected %v command: %v", cmd, err)
+		rec.Event, rec.Error = AuditRejected, err.Error()
+		audit(a.Audit, rec)
+		return nil, fmt.Errorf("agent %s: %v", name, err)
+	}
+	b, err := f(in)
+	finish(err)
+	if err != nil {
+		rec.Event, rec.Error = AuditFailed, err.Error()
+		audit(a.Audit, rec)
 		return nil, err
 	}
+	if a.Policy != nil {
+		a.Policy.record(cmd)
+	}
+	if cmd != GetStatus {
+		// The log lines are not worth keeping in the audit trail.
+		rec.Event = AuditExecuted
+		if cmd != GetLogs {
+			rec.Result = b
+		}
+		audit(a.Audit, rec)
+	}
+	if cmd == SoftShutdown {
+		a.startDrain()
+	}
+
+	out := fmt.Sprintf("%c%s", cmd, b)
+	return a.encodeReply(id, []byte(out), encrypted)
+}
+
+// encodeReply signs the reply data to the request with the given id if the
+// agent has a Signer and encrypts it if encrypt is true.
+func (a *Agent) encodeReply(id string, data []byte, encrypt bool) ([]byte, error) {
+	var err error
+	if a.Signer != nil {
+		if data, err = signReply(id, data, a.Signer); err != nil {
+			return nil, err
+		}
+	}
+	if encrypt {
+		return a.Keyring.seal(data, adReply)
+	}
+	return data, nil
+}
+
+// openRequest decrypts an encrypted request.
+func (a *Agent) openRequest(data []byte) ([]byte, error) {
+	if a.Keyring == nil {
+		return nil, ErrNoKey
+	}
+	return a.Keyring.open(data, adRequest)
+}
+
+// authenticate checks the signature of the request if the agent has trusted
+// keys or CAs. It returns the identity of the sender, which is empty if the
+// request is not signed by a trusted key or certificate.
+func (a *Agent) authenticate(req envelope) (string, error) {
+	if len(a.TrustedKeys) == 0 && a.TrustedCAs == nil {
+		return "", nil
+	}
+	if req.Sig == nil && req.Cmd == GetStatus && a.AllowUnsignedStatus {
+		return "", nil
+	}
+	if len(req.Certs) > 0 && a.SupervisorOU == "" && a.Authorizer == nil {
+		// Any agent could command the fleet with its certificate.
+		return "", ErrUntrustedCert
+	}
+	if err := req.verify(a.TrustedKeys, a.TrustedCAs, a.SupervisorOU); err != nil {
+		return "", err
+	}
+	return req.KeyID, nil
+}
+
+// checkReplay returns an error if the request has expired or has already been
+// received. Requests without id are only accepted from supervisors that do not
+// sign their commands or set a CommandTTL (i.e. when they are in the legacy
+// format), so agents keep working with them.
+func (a *Agent) checkReplay(req envelope) error {
+	if req.ID == "" {
+		if req.Sig != nil || req.TTL > 0 {
+			return errMissingID
+		}
+		return nil
+	}
+	now := time.Now()
+	if req.expired(now, a.MaxCommandAge, a.ClockSkew) {
+		return ErrExpired
+	}
 
 	a.mu.Lock()
-	a.status.Running = running
-	a.mu.Unlock()
+	defer a.mu.Unlock()
 
-	out := fmt.Sprintf("%c%s", cmd, b)
-	return []byte(out), nil
+	for id, exp := range a.seen {
+		if now.After(exp) {
+			delete(a.seen, id)
+		}
+	}
+	if _, ok := a.seen[req.ID]; ok {
+		return ErrReplayed
+	}
+	// The id must be remembered for as long as the command could be
+	// accepted.
+	lifetime := a.MaxCommandAge
+	if req.TTL > 0 && (lifetime <= 0 || req.TTL < lifetime) {
+		lifetime = req.TTL
+	}
+	exp := req.IssuedAt.Add(lifetime + a.ClockSkew)
+	if lifetime <= 0 {
+		// Neither TTL nor MaxCommandAge; remember the id forever.
+		exp = time.Unix(1<<62, 0)
+	}
+	a.seen[req.ID] = exp
+	return nil
 }
 
 func (a *Agent) getStatus(data []byte) ([]byte, error) {
+	// The supervisor sends the sequence number of the last update it
+	// received from every agent.
+	var acks map[string]uint64
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &acks); err != nil {
+			return nil, err
+		}
+	}
+	a.mu.RLock()
+	base := acks[a.status.Name]
+	a.mu.RUnlock()
+	b, _, err := a.statusUpdate(base)
+	return b, err
+}
+
+// statusUpdate returns the current status of the agent. If delta encoding is
+// enabled and the update with sequence number base is known, only the changes
+// since that update are returned. The sequence number of the new update is
+// returned too.
+func (a *Agent) statusUpdate(base uint64) ([]byte, uint64, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	info, err := getSystemInfo()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	a.status.Info = info
-	return json.Marshal(a.status)
+	a.status.Seq++
+	b, err := json.Marshal(a.status)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seq := a.status.Seq
+	if !a.DeltaUpdates {
+		return b, seq, nil
+	}
+	a.history[seq] = b
+	for s := range a.history {
+		if seq-s >= uint64(a.SnapshotEvery) {
+			delete(a.history, s)
+		}
+	}
+	old, ok := a.history[base]
+	if !ok || a.SnapshotEvery <= 1 || seq%uint64(a.SnapshotEvery) == 0 {
+		return b, seq, nil
+	}
+	d, err := diffStatus(old, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	d.Name, d.Seq, d.Base = a.status.Name, seq, base
+	if b, err = json.Marshal(d); err != nil {
+		return nil, 0, err
+	}
+	return b, seq, nil
 }
 
 func (a *Agent) ownsTask(id string) bool {
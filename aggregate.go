@@ -0,0 +1,158 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"math"
+	"sort"
+)
+
+// Aggregate summarizes the status of a set of agents.
+type Aggregate struct {
+	// Agents is the number of agents.
+	Agents int
+
+	// ByState counts the agents by lifecycle state (e.g. "running" or
+	// "paused").
+	ByState map[string]int
+
+	// ByLabel counts the agents by label. It is indexed by label key and
+	// then by label value.
+	ByLabel map[string]map[string]int
+
+	// TotalCPU and AvgCPU are the sum and the mean of the CPU usage of the
+	// agents' hosts.
+	TotalCPU float64
+	AvgCPU   float64
+
+	// TotalRam and UsedRam are the sum of the RAM and the used RAM of the
+	// agents' hosts in bytes. AvgRamUsage is the mean of the used RAM
+	// ratio.
+	TotalRam    uint64
+	UsedRam     uint64
+	AvgRamUsage float64
+
+	// Tasks is the number of running tasks.
+	Tasks int
+
+	// Busiest and Idlest are the names of the agents whose hosts have the
+	// highest and the lowest CPU usage.
+	Busiest string
+	Idlest  string
+
+	// Distributions holds the distribution of every numeric SystemInfo
+	// field, indexed by field name (e.g. "FreeRam" or "Proc.CPU"). Uptime
+	// is expressed in seconds.
+	Distributions map[string]Distribution
+}
+
+// Distribution describes the distribution of a set of values.
+type Distribution struct {
+	Min  float64
+	Max  float64
+	Mean float64
+	P50  float64
+	P90  float64
+	P99  float64
+}
+
+// infoFields maps the name of the numeric SystemInfo fields to functions
+// returning their value.
+var infoFields = map[string]func(SystemInfo) float64{
+	"TotalRam":      func(si SystemInfo) float64 { return float64(si.TotalRam) },
+	"FreeRam":       func(si SystemInfo) float64 { return float64(si.FreeRam) },
+	"TotalSwap":     func(si SystemInfo) float64 { return float64(si.TotalSwap) },
+	"FreeSwap":      func(si SystemInfo) float64 { return float64(si.FreeSwap) },
+	"CPU":           func(si SystemInfo) float64 { return si.CPU },
+	"Uptime":        func(si SystemInfo) float64 { return si.Uptime.Seconds() },
+	"Proc.TotalRam": func(si SystemInfo) float64 { return float64(si.Proc.TotalRam) },
+	"Proc.CPU":      func(si SystemInfo) float64 { return si.Proc.CPU },
+}
+
+// AggregateStatus computes the aggregate of the given status.
+func AggregateStatus(status []Status) Aggregate {
+	agg := Aggregate{
+		Agents:        len(status),
+		ByState:       map[string]int{},
+		ByLabel:       map[string]map[string]int{},
+		Distributions: map[string]Distribution{},
+	}
+	if len(status) == 0 {
+		return agg
+	}
+
+	busiest, idlest := math.Inf(-1), math.Inf(1)
+	for _, st := range status {
+		agg.ByState[string(st.State)]++
+		for k, v := range st.Labels {
+			if agg.ByLabel[k] == nil {
+				agg.ByLabel[k] = map[string]int{}
+			}
+			agg.ByLabel[k][v]++
+		}
+
+		agg.TotalCPU += st.Info.CPU
+		agg.TotalRam += st.Info.TotalRam
+		agg.UsedRam += st.Info.TotalRam - st.Info.FreeRam
+		if st.Info.TotalRam > 0 {
+			agg.AvgRamUsage += float64(st.Info.TotalRam-st.Info.FreeRam) / float64(st.Info.TotalRam)
+		}
+		agg.Tasks += len(st.Tasks)
+
+		if st.Info.CPU > busiest {
+			busiest, agg.Busiest = st.Info.CPU, st.Name
+		}
+		if st.Info.CPU < idlest {
+			idlest, agg.Idlest = st.Info.CPU, st.Name
+		}
+	}
+	agg.AvgCPU = agg.TotalCPU / float64(len(status))
+	agg.AvgRamUsage /= float64(len(status))
+
+	for name, value := range infoFields {
+		values := make([]float64, len(status))
+		for i, st := range status {
+			values[i] = value(st.Info)
+		}
+		agg.Distributions[name] = distribution(values)
+	}
+	return agg
+}
+
+// Aggregate returns the aggregate of the status of all the online agents.
+func (s *Supervisor) Aggregate() Aggregate {
+	return AggregateStatus(s.Status())
+}
+
+func distribution(values []float64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	return Distribution{
+		Min:  sorted[0],
+		Max:  sorted[len(sorted)-1],
+		Mean: sum / float64(len(sorted)),
+		P50:  percentile(sorted, 50),
+		P90:  percentile(sorted, 90),
+		P99:  percentile(sorted, 99),
+	}
+}
+
+// percentile returns the p-th percentile of the sorted values using the
+// nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
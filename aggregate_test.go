@@ -0,0 +1,63 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import "testing"
+
+func TestAggregateStatus(t *testing.T) {
+	status := []Status{
+		{
+			Name:   "a",
+			Labels: map[string]string{"role": "crawler"},
+			State:  Running,
+			Tasks:  []string{"t1", "t2"},
+			Info:   SystemInfo{CPU: 0.5, TotalRam: 100, FreeRam: 50},
+		},
+		{
+			Name:   "b",
+			Labels: map[string]string{"role": "crawler"},
+			State:  Stopped,
+			Info:   SystemInfo{CPU: 0.1, TotalRam: 100, FreeRam: 100},
+		},
+		{
+			Name:   "c",
+			Labels: map[string]string{"role": "indexer"},
+			State:  Running,
+			Tasks:  []string{"t3"},
+			Info:   SystemInfo{CPU: 0.9, TotalRam: 200, FreeRam: 50},
+		},
+	}
+
+	agg := AggregateStatus(status)
+	if agg.Agents != 3 {
+		t.Errorf("Agents = %d, want 3", agg.Agents)
+	}
+	if agg.ByState["running"] != 2 || agg.ByState["stopped"] != 1 {
+		t.Errorf("ByState = %v", agg.ByState)
+	}
+	if agg.ByLabel["role"]["crawler"] != 2 || agg.ByLabel["role"]["indexer"] != 1 {
+		t.Errorf("ByLabel = %v", agg.ByLabel)
+	}
+	if agg.Tasks != 3 {
+		t.Errorf("Tasks = %d, want 3", agg.Tasks)
+	}
+	if agg.TotalRam != 400 || agg.UsedRam != 200 {
+		t.Errorf("TotalRam = %d, UsedRam = %d", agg.TotalRam, agg.UsedRam)
+	}
+	if agg.Busiest != "c" || agg.Idlest != "b" {
+		t.Errorf("Busiest = %q, Idlest = %q", agg.Busiest, agg.Idlest)
+	}
+	cpu := agg.Distributions["CPU"]
+	if cpu.Min != 0.1 || cpu.Max != 0.9 || cpu.P50 != 0.5 {
+		t.Errorf("Distributions[CPU] = %+v", cpu)
+	}
+}
+
+func TestAggregateStatusEmpty(t *testing.T) {
+	agg := AggregateStatus(nil)
+	if agg.Agents != 0 || agg.Busiest != "" {
+		t.Errorf("AggregateStatus(nil) = %+v", agg)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit events.
+const (
+	// AuditInvoke is recorded by the supervisors for every invocation.
+	AuditInvoke = "invoke"
+
+	// AuditReply is recorded by the supervisors for every reply to a
+	// command.
+	AuditReply = "reply"
+
+	// AuditExecuted is recorded by the agents when a command is executed
+	// successfully.
+	AuditExecuted = "executed"
+
+	// AuditFailed is recorded by the agents when the function registered
+	// for a command returns an error.
+	AuditFailed = "failed"
+
+	// AuditRejected is recorded by the agents when a command is rejected
+	// (e.g. bad signature or permission denied).
+	AuditRejected = "rejected"
+)
+
+// An AuditRecord describes a command sent by a supervisor or handled by an
+// agent.
+type AuditRecord struct {
+	Time  time.Time
+	Event string
+
+	// ID is the id of the request.
+	ID string
+
+	// Issuer is the identity of the supervisor that sent the command, if
+	// known.
+	Issuer string `json:",omitempty"`
+
+	// Agent is the name of the agent that recorded the event or, in the
+	// records of the supervisors, the identity of the agent that replied,
+	// if known.
+	Agent string `json:",omitempty"`
+
+	Command string
+	Target  string `json:",omitempty"`
+	Args    []byte `json:",omitempty"`
+
+	// Result contains the data returned by the agent.
+	Result []byte `json:",omitempty"`
+
+	Error string `json:",omitempty"`
+}
+
+// An AuditSink stores audit records.
+type AuditSink interface {
+	Record(r AuditRecord) error
+}
+
+// AuditFunc is an adapter to allow the use of ordinary functions as audit
+// sinks.
+type AuditFunc func(r AuditRecord) error
+
+// Record calls f(r).
+func (f AuditFunc) Record(r AuditRecord) error {
+	return f(r)
+}
+
+// audit records r in sink, if not nil. Errors are logged.
+func audit(sink AuditSink, r AuditRecord) {
+	if sink == nil {
+		return
+	}
+	r.Time = time.Now()
+	if err := sink.Record(r); err != nil {
+		logf("audit: %v", err)
+	}
+}
+
+// A FileSink writes audit records to a file in JSON lines format. When the
+// file exceeds MaxSize bytes it is rotated, keeping MaxBackups old files named
+// path.1, path.2, etc.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewFileSink returns a FileSink that writes to the file at path. A maxSize
+// lower than or equal to zero disables the rotation.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	f, size, err := openAuditFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups, f: f, size: size}, nil
+}
+
+// openAuditFile opens the file at path for appending, creating it if
+// needed, and returns its size.
+func openAuditFile(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// Record writes r to the file.
+func (fs *FileSink) Record(r AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.f == nil {
+		return os.ErrClosed
+	}
+	if fs.maxSize > 0 && fs.size > 0 && fs.size+int64(len(b)) > fs.maxSize {
+		// If the rotation fails, the record is written to the
+		// current file and the rotation is retried with the
+		// following record.
+		if err := fs.rotate(); err != nil {
+			logf("audit: rotate %s: %v", fs.path, err)
+		}
+	}
+	n, err := fs.f.Write(b)
+	fs.size += int64(n)
+	return err
+}
+
+// rotate renames the current file and opens a new one. The current file is
+// kept open until the new one is opened, so a failed rotation does not stop
+// the auditing. If the current file was already renamed by a previous
+// attempt, only the new file is opened. The caller must hold fs.mu.
+func (fs *FileSink) rotate() error {
+	if _, err := os.Stat(fs.path); err == nil {
+		if fs.maxBackups > 0 {
+			for i := fs.maxBackups - 1; i > 0; i-- {
+				old := fmt.Sprintf("%s.%d", fs.path, i)
+				if _, err := os.Stat(old); err == nil {
+					if err := os.Rename(old, fmt.Sprintf("%s.%d", fs.path, i+1)); err != nil {
+						return err
+					}
+				}
+			}
+			if err := os.Rename(fs.path, fs.path+".1"); err != nil {
+				return err
+			}
+		} else if err := os.Remove(fs.path); err != nil {
+			return err
+		}
+	}
+	f, size, err := openAuditFile(fs.path)
+	if err != nil {
+		return err
+	}
+	if err := fs.f.Close(); err != nil {
+		logf("audit: close %s: %v", fs.path, err)
+	}
+	fs.f, fs.size = f, size
+	return nil
+}
+
+// Close closes the file.
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.f == nil {
+		return nil
+	}
+	err := fs.f.Close()
+	fs.f = nil
+	return err
+}
+
+// auditInvoke records the invocation r and remembers it during the audit
+// window, so the replies can be correlated with the original command.
+func (s *Supervisor) auditInvoke(r AuditRecord) {
+	if s.Audit == nil {
+		return
+	}
+	if r.Issuer == "" && s.Signer != nil {
+		r.Issuer = s.Signer.KeyID()
+	}
+	r.Event = AuditInvoke
+	audit(s.Audit, r)
+
+	s.amu.Lock()
+	defer s.amu.Unlock()
+
+	window := s.AuditWindow
+	if s.CommandTTL > window {
+		window = s.CommandTTL
+	}
+	for id, inv := range s.invoked {
+		if time.Since(inv.Time) > window {
+			delete(s.invoked, id)
+		}
+	}
+	r.Time = time.Now()
+	s.invoked[r.ID] = r
+}
+
+// auditReply records the reply to a command invoked by the supervisor.
+// A command can be replied by several agents. Replies to the heartbeats are
+// ignored.
+func (s *Supervisor) auditReply(reply Reply) {
+	if s.Audit == nil {
+		return
+	}
+
+	s.amu.Lock()
+	inv, ok := s.invoked[reply.ID]
+	s.amu.Unlock()
+
+	if !ok {
+		return
+	}
+	audit(s.Audit, AuditRecord{
+		Event:   AuditReply,
+		ID:      reply.ID,
+		Issuer:  inv.Issuer,
+		Agent:   reply.Agent,
+		Command: inv.Command,
+		Target:  inv.Target,
+		Result:  reply.Data,
+		Error:   reply.Err,
+	})
+}
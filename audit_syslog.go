@@ -0,0 +1,42 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package monmq
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// A SyslogSink sends audit records to the system log as JSON messages.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink returns a SyslogSink that logs with the given tag using the
+// facility LOG_AUTH.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_NOTICE, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+// Record sends r to the system log.
+func (s *SyslogSink) Record(r AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.w.Notice(string(b))
+}
+
+// Close closes the connection to the system log.
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
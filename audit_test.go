@@ -0,0 +1,228 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+func readAudit(t *testing.T, path string) []AuditRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	fs, err := NewFileSink(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := fs.Record(AuditRecord{Event: AuditInvoke, ID: "id", Command: "Pause", Target: "w1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 200 {
+			t.Errorf("%s: size = %d, want <= 200", p, fi.Size())
+		}
+		if len(readAudit(t, p)) == 0 {
+			t.Errorf("%s: no records", p)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("unexpected backup %s.3", path)
+	}
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	fs, err := NewFileSink(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	// The backup cannot be created while a directory has its name.
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	r := AuditRecord{Event: AuditInvoke, ID: "id", Command: "Pause", Target: "w1"}
+	for i := 0; i < 5; i++ {
+		if err := fs.Record(r); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+	if n := len(readAudit(t, path)); n != 5 {
+		t.Errorf("%d records written during the failed rotations, want 5", n)
+	}
+
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Record(r); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readAudit(t, path)); n != 1 {
+		t.Errorf("%d records in the new file, want 1", n)
+	}
+	if n := len(readAudit(t, path+".1")); n != 5 {
+		t.Errorf("%d records in the backup, want 5", n)
+	}
+}
+
+func TestAgentAudit(t *testing.T) {
+	key := HMACKey{ID: "ops", Secret: []byte("secret")}
+	var records []AuditRecord
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.TrustedKeys = []Verifier{key}
+	a.HardShutdownFunc = func(data []byte) ([]byte, error) { return nil, nil }
+	a.Audit = AuditFunc(func(r AuditRecord) error {
+		records = append(records, r)
+		return nil
+	})
+
+	s := NewSupervisor("", "", "")
+	s.Signer = key
+	data, err := s.encodeRequest(Pause, "w1", []byte("now"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.invoke("id1", data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.invoke("id2", encodeInvocation(HardShutdown, "w1", nil)); err == nil {
+		t.Fatal("expected error")
+	}
+	// Commands for other agents are not audited.
+	if _, err := a.invoke("id3", encodeInvocation(HardShutdown, "w2", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("records = %+v", records)
+	}
+	want := []AuditRecord{
+		{Event: AuditExecuted, ID: "id1", Issuer: "ops", Agent: "w1", Command: "Pause", Target: "w1"},
+		{Event: AuditRejected, ID: "id2", Agent: "w1", Command: "HardShutdown", Target: "w1"},
+	}
+	for i, r := range records {
+		w := want[i]
+		if r.Event != w.Event || r.ID != w.ID || r.Issuer != w.Issuer || r.Agent != w.Agent ||
+			r.Command != w.Command || r.Target != w.Target || r.Time.IsZero() {
+			t.Errorf("record %d = %+v, want %+v", i, r, w)
+		}
+	}
+	if string(records[0].Args) != "now" {
+		t.Errorf("Args = %q, want %q", records[0].Args, "now")
+	}
+	if records[1].Error == "" {
+		t.Error("rejected record without error")
+	}
+}
+
+func TestSupervisorAuditReplies(t *testing.T) {
+	var records []AuditRecord
+	s := NewSupervisor("", "", "")
+	s.Signer = HMACKey{ID: "ops", Secret: []byte("secret")}
+	s.Audit = AuditFunc(func(r AuditRecord) error {
+		records = append(records, r)
+		return nil
+	})
+
+	s.auditInvoke(AuditRecord{ID: "id1", Command: "HardShutdown", Target: "w17"})
+	s.deliver(rpcmq.Result{UUID: "id1", Data: []byte{byte(HardShutdown)}}, "w17")
+	s.deliver(rpcmq.Result{UUID: "id1", Err: "agent w17: permission denied"}, "")
+	// Heartbeat replies are not correlated with any invocation.
+	s.deliver(rpcmq.Result{UUID: "hb", Data: []byte{byte(GetStatus), '{', '}'}}, "")
+
+	if len(records) != 3 {
+		t.Fatalf("records = %+v", records)
+	}
+	if r := records[0]; r.Event != AuditInvoke || r.Issuer != "ops" || r.Target != "w17" {
+		t.Errorf("invoke record = %+v", r)
+	}
+	for _, r := range records[1:] {
+		if r.Event != AuditReply || r.ID != "id1" || r.Issuer != "ops" || r.Command != "HardShutdown" || r.Target != "w17" {
+			t.Errorf("reply record = %+v", r)
+		}
+	}
+	if records[1].Agent != "w17" {
+		t.Errorf("reply record: Agent = %q, want %q", records[1].Agent, "w17")
+	}
+	if records[2].Error == "" {
+		t.Error("reply record without error")
+	}
+}
+
+func TestSupervisorAuditIssuerAndWindow(t *testing.T) {
+	var records []AuditRecord
+	s := NewSupervisor("", "", "")
+	s.Signer = HMACKey{ID: "ops", Secret: []byte("secret")}
+	s.Audit = AuditFunc(func(r AuditRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	// Replies to slow commands arrive after the agents are considered
+	// offline.
+	s.Timeout = time.Millisecond
+
+	s.auditInvoke(AuditRecord{ID: "id1", Issuer: "alice", Command: "Pause", Target: "w1"})
+	time.Sleep(5 * time.Millisecond)
+	s.auditInvoke(AuditRecord{ID: "id2", Command: "Pause", Target: "w2"})
+	s.deliver(rpcmq.Result{UUID: "id1", Data: []byte{byte(Pause)}}, "w1")
+
+	if len(records) != 3 {
+		t.Fatalf("records = %+v", records)
+	}
+	if r := records[0]; r.Issuer != "alice" {
+		t.Errorf("invoke record issuer = %q, want alice", r.Issuer)
+	}
+	if r := records[1]; r.Issuer != "ops" {
+		t.Errorf("invoke record issuer = %q, want the key id", r.Issuer)
+	}
+	if r := records[2]; r.Event != AuditReply || r.ID != "id1" || r.Issuer != "alice" {
+		t.Errorf("reply record = %+v", r)
+	}
+
+	// Invocations are forgotten after the audit window.
+	s.AuditWindow = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	s.auditInvoke(AuditRecord{ID: "id3", Command: "Pause", Target: "w3"})
+	s.deliver(rpcmq.Result{UUID: "id1", Data: []byte{byte(Pause)}}, "w1")
+	if len(records) != 4 {
+		t.Errorf("reply recorded after the audit window: %+v", records[4:])
+	}
+}
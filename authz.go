@@ -0,0 +1,194 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync"
+)
+
+// ErrDenied is returned by the agents when the identity that sent a command
+// is not allowed to invoke it.
+var ErrDenied = errors.New("permission denied")
+
+// A Role grants the permission to invoke a set of commands on a set of
+// targets.
+type Role struct {
+	// Commands is the list of allowed commands by name. "*" allows all of
+	// them.
+	Commands []string `json:"commands"`
+
+	// Targets is the list of shell patterns (see path.Match) matched
+	// against the name of the agent that executes the commands. That is,
+	// the target of the commands sent to an agent, the agent that owns
+	// the task in the case of KillTask and every agent in the case of
+	// GetStatus. If it is empty, any agent is allowed.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// An AccessPolicy maps identities to roles. The identity of a command is the
+// id of the key used to sign it. Unsigned commands have an empty identity.
+type AccessPolicy struct {
+	// Roles are the roles indexed by name.
+	Roles map[string]Role `json:"roles"`
+
+	// Identities maps identities to role names.
+	Identities map[string][]string `json:"identities"`
+
+	// Default is the list of role names granted to every identity,
+	// including the empty one.
+	Default []string `json:"default,omitempty"`
+}
+
+// validate checks that the roles and commands referenced by the policy exist.
+func (p AccessPolicy) validate() error {
+	for name, r := range p.Roles {
+		for _, c := range r.Commands {
+			if c == "*" {
+				continue
+			}
+			if _, err := ParseCommand(c); err != nil {
+				return fmt.Errorf("role %s: %v", name, err)
+			}
+		}
+		for _, t := range r.Targets {
+			if _, err := path.Match(t, ""); err != nil {
+				return fmt.Errorf("role %s: %v", name, err)
+			}
+		}
+	}
+	roles := append([]string(nil), p.Default...)
+	for _, rs := range p.Identities {
+		roles = append(roles, rs...)
+	}
+	for _, r := range roles {
+		if _, ok := p.Roles[r]; !ok {
+			return fmt.Errorf("unknown role %s", r)
+		}
+	}
+	return nil
+}
+
+// allows reports whether identity can invoke cmd on the given agent.
+func (p AccessPolicy) allows(identity string, cmd Command, agent string) bool {
+	roles := append(append([]string(nil), p.Default...), p.Identities[identity]...)
+	for _, name := range roles {
+		if p.Roles[name].allows(cmd, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Role) allows(cmd Command, agent string) bool {
+	allowed := false
+	for _, c := range r.Commands {
+		if c == "*" {
+			allowed = true
+			break
+		}
+		if rc, err := ParseCommand(c); err == nil && rc == cmd {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if len(r.Targets) == 0 {
+		return true
+	}
+	for _, t := range r.Targets {
+		if ok, _ := path.Match(t, agent); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// An Authorizer enforces an AccessPolicy loaded from a JSON file like the
+// following one:
+//
+//	{
+//		"roles": {
+//			"viewer": {"commands": ["GetStatus"]},
+//			"operator": {"commands": ["GetStatus", "Pause", "Resume", "KillTask"]},
+//			"admin": {"commands": ["*"]}
+//		},
+//		"identities": {
+//			"ops-key": ["operator"],
+//			"root-key": ["admin"]
+//		},
+//		"default": ["viewer"]
+//	}
+type Authorizer struct {
+	path string
+
+	mu     sync.RWMutex
+	policy AccessPolicy
+}
+
+// LoadAuthorizer returns an Authorizer that enforces the policy in the file
+// at the given path.
+func LoadAuthorizer(path string) (*Authorizer, error) {
+	az := &Authorizer{path: path}
+	if err := az.Reload(); err != nil {
+		return nil, err
+	}
+	return az, nil
+}
+
+// NewAuthorizer returns an Authorizer that enforces the given policy. Reload
+// has no effect on it.
+func NewAuthorizer(p AccessPolicy) (*Authorizer, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &Authorizer{policy: p}, nil
+}
+
+// Reload reads the policy file again. If the new policy is not valid, the
+// current one is kept and an error is returned.
+func (az *Authorizer) Reload() error {
+	if az.path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(az.path)
+	if err != nil {
+		return err
+	}
+	var p AccessPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	az.mu.Lock()
+	defer az.mu.Unlock()
+
+	az.policy = p
+	return nil
+}
+
+// Authorize returns an error wrapping ErrDenied if identity is not allowed to
+// invoke cmd on the agent with the given name (see Role.Targets).
+func (az *Authorizer) Authorize(identity string, cmd Command, agent string) error {
+	az.mu.RLock()
+	defer az.mu.RUnlock()
+
+	if az.policy.allows(identity, cmd, agent) {
+		return nil
+	}
+	if identity == "" {
+		identity = "anonymous"
+	}
+	return fmt.Errorf("%w: %s cannot invoke %v on %q", ErrDenied, identity, cmd, agent)
+}
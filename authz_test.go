@@ -0,0 +1,181 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{
+	"roles": {
+		"viewer": {"commands": ["GetStatus"]},
+		"operator": {"commands": ["Pause", "Resume", "KillTask"], "targets": ["crawler-*"]},
+		"admin": {"commands": ["*"]}
+	},
+	"identities": {
+		"ops": ["operator"],
+		"root": ["admin"]
+	},
+	"default": ["viewer"]
+}`
+
+func writePolicy(t *testing.T, dir, policy string) string {
+	path := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	az, err := LoadAuthorizer(writePolicy(t, dir, testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		identity string
+		cmd      Command
+		target   string
+		allowed  bool
+	}{
+		{"", GetStatus, "", true},
+		{"", Pause, "crawler-1", false},
+		{"ops", Pause, "crawler-1", true},
+		{"ops", Pause, "indexer-1", false},
+		{"ops", HardShutdown, "crawler-1", false},
+		{"root", HardShutdown, "indexer-1", true},
+	}
+	for _, tt := range tests {
+		err := az.Authorize(tt.identity, tt.cmd, tt.target)
+		if (err == nil) != tt.allowed {
+			t.Errorf("Authorize(%q, %v, %q) = %v", tt.identity, tt.cmd, tt.target, err)
+		}
+		if err != nil && !errors.Is(err, ErrDenied) {
+			t.Errorf("error %v does not wrap ErrDenied", err)
+		}
+	}
+
+	// Invalid policies are not loaded.
+	writePolicy(t, dir, `{"roles": {}, "identities": {"ops": ["operator"]}}`)
+	if err := az.Reload(); err == nil {
+		t.Error("invalid policy loaded")
+	}
+	if err := az.Authorize("ops", Pause, "crawler-1"); err != nil {
+		t.Errorf("previous policy not kept: %v", err)
+	}
+
+	writePolicy(t, dir, strings.Replace(testPolicy, `"ops": ["operator"]`, `"ops": ["viewer"]`, 1))
+	if err := az.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := az.Authorize("ops", Pause, "crawler-1"); err == nil {
+		t.Error("reloaded policy not enforced")
+	}
+}
+
+func TestAgentAuthorization(t *testing.T) {
+	ops := HMACKey{ID: "ops", Secret: []byte("ops secret")}
+	root := HMACKey{ID: "root", Secret: []byte("root secret")}
+	az, err := NewAuthorizer(AccessPolicy{
+		Roles: map[string]Role{
+			"operator": {Commands: []string{"Pause"}},
+			"admin":    {Commands: []string{"*"}},
+		},
+		Identities: map[string][]string{"ops": {"operator"}, "root": {"admin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.HardShutdownFunc = a.PauseFunc
+	a.TrustedKeys = []Verifier{ops, root}
+	a.Authorizer = az
+
+	tests := []struct {
+		key     HMACKey
+		cmd     Command
+		allowed bool
+	}{
+		{ops, Pause, true},
+		{ops, HardShutdown, false},
+		{root, HardShutdown, true},
+	}
+	for _, tt := range tests {
+		s := NewSupervisor("", "", "")
+		s.Signer = tt.key
+		data, err := s.encodeRequest(tt.cmd, "w1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = 0
+		_, err = a.invoke("id", data)
+		if (err == nil) != tt.allowed || (calls == 1) != tt.allowed {
+			t.Errorf("%s invoking %v: error = %v, calls = %d", tt.key.ID, tt.cmd, err, calls)
+		}
+		if err != nil && !strings.Contains(err.Error(), ErrDenied.Error()) {
+			t.Errorf("error %q does not report the denial", err)
+		}
+	}
+}
+
+func TestAgentAuthorizationTargets(t *testing.T) {
+	ops := HMACKey{ID: "ops", Secret: []byte("ops secret")}
+	az, err := NewAuthorizer(AccessPolicy{
+		Roles: map[string]Role{
+			"web": {Commands: []string{"GetStatus", "KillTask"}, Targets: []string{"web-*"}},
+		},
+		Identities: map[string][]string{"ops": {"web"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		agent   string
+		cmd     Command
+		target  string
+		allowed bool
+	}{
+		// Targets are matched against the agent that owns the task.
+		{"web-1", KillTask, "t1", true},
+		{"db-1", KillTask, "t1", false},
+		// GetStatus is broadcast to every agent.
+		{"web-1", GetStatus, "", true},
+		{"db-1", GetStatus, "", false},
+	}
+	for _, tt := range tests {
+		a := NewAgent("", "", tt.agent)
+		a.status.State = Running
+		a.KillGracePeriod = 0
+		a.TrustedKeys = []Verifier{ops}
+		a.Authorizer = az
+		a.RegisterTask("t1")
+
+		s := NewSupervisor("", "", "")
+		s.Signer = ops
+		data, err := s.encodeRequest(tt.cmd, tt.target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = a.invoke("id", data)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%v %q on %s: error = %v", tt.cmd, tt.target, tt.agent, err)
+		}
+	}
+}
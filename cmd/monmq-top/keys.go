@@ -0,0 +1,281 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	"github.com/jroimartin/monmq"
+)
+
+const helpText = `Agents
+  Up/Down  move cursor          Tab     switch to tasks
+  s        change sort column   /       filter agents (name or key=value)
+  p        Pause                r       Resume
+  k        SoftShutdown         K       HardShutdown
+  c        send CustomCmd
+
+Tasks
+  Up/Down  move cursor          Tab     switch to agents
+  x        KillTask
+
+Shutdowns and KillTask must be confirmed with y (or cancelled with n).
+
+General
+  ?        show/hide this help  Ctrl-C  quit`
+
+type binding struct {
+	view    string
+	key     interface{}
+	handler func(g *gocui.Gui, v *gocui.View) error
+}
+
+func keybindings(g *gocui.Gui) error {
+	bindings := []binding{
+		{"", gocui.KeyCtrlC, quit},
+		{"agents", gocui.KeyArrowDown, cursorDown},
+		{"agents", gocui.KeyArrowUp, cursorUp},
+		{"agents", gocui.KeyTab, focus("tasks")},
+		{"agents", 's', sortAgents},
+		{"agents", '/', prompt("filter", "Filter", setFilter)},
+		{"agents", 'p', request(monmq.Pause, "agents")},
+		{"agents", 'r', request(monmq.Resume, "agents")},
+		{"agents", 'k', request(monmq.SoftShutdown, "agents")},
+		{"agents", 'K', request(monmq.HardShutdown, "agents")},
+		{"agents", 'c', prompt("custom", "CustomCmd arguments", sendCustom)},
+		{"agents", '?', toggleHelp},
+		{"tasks", gocui.KeyArrowDown, cursorDown},
+		{"tasks", gocui.KeyArrowUp, cursorUp},
+		{"tasks", gocui.KeyTab, focus("agents")},
+		{"tasks", 'x', request(monmq.KillTask, "tasks")},
+		{"tasks", '?', toggleHelp},
+		{"help", '?', toggleHelp},
+		{"help", gocui.KeyEsc, toggleHelp},
+		{"filter", gocui.KeyEnter, submit("filter")},
+		{"filter", gocui.KeyEsc, cancel("filter")},
+		{"custom", gocui.KeyEnter, submit("custom")},
+		{"custom", gocui.KeyEsc, cancel("custom")},
+		{"confirm", 'y', confirmed},
+		{"confirm", 'n', dismiss},
+		{"confirm", gocui.KeyEsc, dismiss},
+	}
+	for _, b := range bindings {
+		if err := g.SetKeybinding(b.view, b.key, gocui.ModNone, b.handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func quit(g *gocui.Gui, v *gocui.View) error {
+	return gocui.ErrQuit
+}
+
+func cursorDown(g *gocui.Gui, v *gocui.View) error {
+	if v != nil {
+		cx, cy := v.Cursor()
+		if _, err := v.Line(cy + 1); err != nil {
+			return nil
+		}
+		if err := v.SetCursor(cx, cy+1); err != nil {
+			ox, oy := v.Origin()
+			if err := v.SetOrigin(ox, oy+1); err != nil {
+				return err
+			}
+		}
+		ui.setSelection(v.Name(), selectedField(g, v.Name()))
+	}
+	return nil
+}
+
+func cursorUp(g *gocui.Gui, v *gocui.View) error {
+	if v != nil {
+		ox, oy := v.Origin()
+		cx, cy := v.Cursor()
+		if err := v.SetCursor(cx, cy-1); err != nil && oy > 0 {
+			if err := v.SetOrigin(ox, oy-1); err != nil {
+				return err
+			}
+		}
+		ui.setSelection(v.Name(), selectedField(g, v.Name()))
+	}
+	return nil
+}
+
+func focus(view string) func(g *gocui.Gui, v *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		return setCurrentView(g, view)
+	}
+}
+
+// setCurrentView gives the focus to the given view.
+func setCurrentView(g *gocui.Gui, name string) error {
+	_, err := g.SetCurrentView(name)
+	return err
+}
+
+func sortAgents(g *gocui.Gui, v *gocui.View) error {
+	ui.nextSortKey()
+	return update(g)
+}
+
+// request returns a handler that invokes cmd on the agent or task selected
+// in the given view. Destructive commands are not sent until the user
+// confirms them.
+func request(cmd monmq.Command, view string) func(g *gocui.Gui, v *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		target := ui.selection(view)
+		if target == "" {
+			return nil
+		}
+		if destructive(cmd) {
+			return confirm(g, cmd, target, view)
+		}
+		invoke(cmd, target, nil)
+		return nil
+	}
+}
+
+// destructive reports whether cmd must be confirmed by the user.
+func destructive(cmd monmq.Command) bool {
+	switch cmd {
+	case monmq.SoftShutdown, monmq.HardShutdown, monmq.KillTask:
+		return true
+	}
+	return false
+}
+
+// pending is the command waiting for the confirmation of the user. The
+// target is fixed when the command is requested, so it does not change if
+// the rows move meanwhile.
+var pending struct {
+	cmd    monmq.Command
+	target string
+	view   string
+}
+
+// confirm shows a dialog asking the user to confirm cmd on target. The focus
+// returns to view when the dialog is closed.
+func confirm(g *gocui.Gui, cmd monmq.Command, target, view string) error {
+	pending.cmd, pending.target, pending.view = cmd, target, view
+
+	text := fmt.Sprintf("%v %s? (y/n)", cmd, target)
+	maxX, maxY := g.Size()
+	x0 := (maxX-len(text))/2 - 1
+	cv, err := g.SetView("confirm", x0, maxY/2-1, x0+len(text)+2, maxY/2+1)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	cv.Title = "Confirm"
+	cv.Clear()
+	fmt.Fprint(cv, text)
+	return setCurrentView(g, "confirm")
+}
+
+func confirmed(g *gocui.Gui, v *gocui.View) error {
+	if err := dismiss(g, v); err != nil {
+		return err
+	}
+	invoke(pending.cmd, pending.target, nil)
+	return nil
+}
+
+func dismiss(g *gocui.Gui, v *gocui.View) error {
+	if err := g.DeleteView("confirm"); err != nil {
+		return err
+	}
+	return setCurrentView(g, pending.view)
+}
+
+// invoke invokes cmd on target, logging the request. Errors are logged
+// instead of returned so they do not terminate the application.
+func invoke(cmd monmq.Command, target string, args []byte) {
+	if target == "" {
+		return
+	}
+	id, err := supervisor.InvokeArgs(cmd, target, args)
+	if err != nil {
+		ui.logf("%v %s: %v", cmd, target, err)
+		return
+	}
+	ui.logf("%v %s: sent (%s)", cmd, target, id)
+}
+
+// promptFuncs holds the functions called with the text entered in the
+// prompts when the user presses Enter.
+var promptFuncs = map[string]func(g *gocui.Gui, text string) error{}
+
+// prompt returns a handler that shows an editable view called name.
+func prompt(name, title string, f func(g *gocui.Gui, text string) error) func(g *gocui.Gui, v *gocui.View) error {
+	promptFuncs[name] = f
+	return func(g *gocui.Gui, v *gocui.View) error {
+		maxX, maxY := g.Size()
+		pv, err := g.SetView(name, maxX/4, maxY/2-1, maxX*3/4, maxY/2+1)
+		if err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
+		pv.Title = title
+		pv.Editable = true
+		return setCurrentView(g, name)
+	}
+}
+
+func submit(name string) func(g *gocui.Gui, v *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		text := strings.TrimSpace(v.Buffer())
+		if err := cancel(name)(g, v); err != nil {
+			return err
+		}
+		return promptFuncs[name](g, text)
+	}
+}
+
+func cancel(name string) func(g *gocui.Gui, v *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if err := g.DeleteView(name); err != nil {
+			return err
+		}
+		return setCurrentView(g, "agents")
+	}
+}
+
+func setFilter(g *gocui.Gui, text string) error {
+	ui.setFilter(text)
+	return update(g)
+}
+
+func sendCustom(g *gocui.Gui, text string) error {
+	invoke(monmq.CustomCmd, ui.selection("agents"), []byte(text))
+	return nil
+}
+
+func toggleHelp(g *gocui.Gui, v *gocui.View) error {
+	if _, err := g.View("help"); err == nil {
+		if err := g.DeleteView("help"); err != nil {
+			return err
+		}
+		return setCurrentView(g, "agents")
+	}
+
+	lines := strings.Split(helpText, "\n")
+	width := 0
+	for _, l := range lines {
+		if len(l) > width {
+			width = len(l)
+		}
+	}
+	maxX, maxY := g.Size()
+	x0, y0 := (maxX-width)/2-1, (maxY-len(lines))/2-1
+	hv, err := g.SetView("help", x0, y0, x0+width+2, y0+len(lines)+1)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	hv.Title = "Help"
+	hv.Clear()
+	fmt.Fprint(hv, helpText)
+	return setCurrentView(g, "help")
+}
@@ -0,0 +1,30 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jroimartin/monmq"
+)
+
+func TestDestructive(t *testing.T) {
+	tests := []struct {
+		cmd  monmq.Command
+		want bool
+	}{
+		{monmq.Pause, false},
+		{monmq.Resume, false},
+		{monmq.CustomCmd, false},
+		{monmq.SoftShutdown, true},
+		{monmq.HardShutdown, true},
+		{monmq.KillTask, true},
+	}
+	for _, tt := range tests {
+		if got := destructive(tt.cmd); got != tt.want {
+			t.Errorf("destructive(%v) = %v, want %v", tt.cmd, got, tt.want)
+		}
+	}
+}
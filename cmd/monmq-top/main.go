@@ -0,0 +1,132 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Monmq-top is a terminal UI to monitor and control the agents of a monmq
+deployment.
+
+Usage:
+
+	monmq-top [flags]
+
+Press '?' inside the application to show the available key bindings.
+
+Monmq-top uses the API of gocui v0.4.0 or later.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jroimartin/gocui"
+	"github.com/jroimartin/monmq"
+)
+
+const (
+	refreshTime = 1 * time.Second
+	maxLogLines = 100
+)
+
+var (
+	broker   = flag.String("broker", "amqp://localhost:5672", "broker URI")
+	exchange = flag.String("exchange", "mon-exchange", "monitoring exchange")
+	replies  = flag.String("replies", "", "replies queue (default monmq-top-<pid>)")
+)
+
+var (
+	supervisor *monmq.Supervisor
+	ui         = newState()
+)
+
+func main() {
+	flag.Parse()
+
+	q := *replies
+	if q == "" {
+		q = fmt.Sprintf("monmq-top-%d", os.Getpid())
+	}
+	supervisor = monmq.NewSupervisor(*broker, q, *exchange)
+	supervisor.Replies = make(chan monmq.Reply)
+	if err := supervisor.Init(); err != nil {
+		log.Fatalf("Init: %v", err)
+	}
+	defer supervisor.Shutdown()
+
+	g, err := gocui.NewGui(gocui.OutputNormal)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer g.Close()
+
+	g.SetManagerFunc(layout)
+	if err := keybindings(g); err != nil {
+		log.Fatalln(err)
+	}
+	g.SelBgColor = gocui.ColorGreen
+	g.SelFgColor = gocui.ColorBlack
+	g.Highlight = true
+	g.Cursor = true
+
+	go func() {
+		for r := range supervisor.Replies {
+			if r.Err != "" {
+				ui.logf("reply %s: error: %s", r.ID, r.Err)
+				continue
+			}
+			ui.logf("reply %s: %v: %s", r.ID, r.Command, r.Data)
+		}
+	}()
+
+	go func() {
+		for {
+			g.Update(update)
+			time.Sleep(refreshTime)
+		}
+	}()
+
+	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
+		log.Fatalln(err)
+	}
+}
+
+func layout(g *gocui.Gui) error {
+	maxX, maxY := g.Size()
+	midX, logY, tasksY := maxX/2, maxY*2/3, maxY/3
+
+	if v, err := g.SetView("agents", 0, 0, midX, logY-1); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		if _, err := g.SetCurrentView("agents"); err != nil {
+			return err
+		}
+		v.Highlight = true
+	}
+	if v, err := g.SetView("info", midX+1, 0, maxX-1, tasksY); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "Agent"
+		v.Wrap = true
+	}
+	if v, err := g.SetView("tasks", midX+1, tasksY+1, maxX-1, logY-1); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "Tasks"
+		v.Highlight = true
+	}
+	if v, err := g.SetView("log", 0, logY, maxX-1, maxY-1); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "Command replies"
+		v.Wrap = true
+	}
+	return nil
+}
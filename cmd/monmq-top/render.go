@@ -0,0 +1,227 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/gocui"
+	"github.com/jroimartin/monmq"
+)
+
+const agentRow = "%-24s %-8s %6s %6s %5s\n"
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline returns a sparkline of the given values, which must be in the
+// range [0, 1]. Only the last width values are shown.
+func sparkline(values []float64, width int) string {
+	if width < 0 {
+		width = 0
+	}
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	var sb strings.Builder
+	for _, v := range values {
+		idx := int(v * float64(len(sparks)-1))
+		if idx < 0 {
+			idx = 0
+		} else if idx >= len(sparks) {
+			idx = len(sparks) - 1
+		}
+		sb.WriteRune(sparks[idx])
+	}
+	return sb.String()
+}
+
+func update(g *gocui.Gui) error {
+	vagents, err := g.View("agents")
+	if err != nil {
+		return err
+	}
+	vinfo, err := g.View("info")
+	if err != nil {
+		return err
+	}
+	vtasks, err := g.View("tasks")
+	if err != nil {
+		return err
+	}
+	vlog, err := g.View("log")
+	if err != nil {
+		return err
+	}
+
+	agents, desc := ui.agents(supervisor.Status())
+	agg := monmq.AggregateStatus(agents)
+	vagents.Title = fmt.Sprintf("Agents: %d, tasks: %d (%s)", agg.Agents, agg.Tasks, desc)
+	vagents.Clear()
+	renderAgents(vagents, agents)
+	names := make([]string, len(agents))
+	for i, st := range agents {
+		names[i] = st.Name
+	}
+	if err := keepSelection(vagents, names); err != nil {
+		return err
+	}
+
+	vinfo.Clear()
+	vtasks.Clear()
+	if agent, ok := selectedAgent(agents); ok {
+		width, _ := vinfo.Size()
+		renderInfo(vinfo, width, agent, supervisor.History(agent.Name))
+		tasks := supervisor.Tasks(func(ti monmq.TaskInfo) bool { return ti.Agent == agent.Name })
+		renderTasks(vtasks, tasks)
+		ids := make([]string, len(tasks))
+		for i, ti := range tasks {
+			ids[i] = ti.ID
+		}
+		if err := keepSelection(vtasks, ids); err != nil {
+			return err
+		}
+	}
+
+	vlog.Clear()
+	_, height := vlog.Size()
+	renderLog(vlog, ui.logLines(), height)
+	return nil
+}
+
+// renderAgents writes a row of the agents table for every agent.
+func renderAgents(w io.Writer, agents []monmq.Status) {
+	for _, st := range agents {
+		fmt.Fprintf(w, agentRow, st.Name, st.State,
+			fmt.Sprintf("%.1f%%", st.Info.CPU*100),
+			fmt.Sprintf("%.1f%%", ramUsage(st.Info)), fmt.Sprint(len(st.Tasks)))
+	}
+}
+
+// renderInfo writes the details of an agent. The sparklines show the CPU and
+// RAM usage of the given history and fit in width columns.
+func renderInfo(w io.Writer, width int, agent monmq.Status, history []monmq.Status) {
+	info := agent.Info
+	width -= len("CPU:      ") + 8
+	if width < 0 {
+		width = 0
+	}
+
+	var cpu, ram []float64
+	for _, st := range history {
+		cpu = append(cpu, st.Info.CPU)
+		ram = append(ram, ramUsage(st.Info)/100)
+	}
+
+	fmt.Fprintf(w, "Name:     %s\n", agent.Name)
+	fmt.Fprintf(w, "State:    %s (%v)\n", agent.State, time.Since(agent.StateSince).Truncate(time.Second))
+	fmt.Fprintf(w, "Version:  %s\n", info.Version)
+	fmt.Fprintf(w, "CPU:      %5.1f%% %s\n", info.CPU*100, sparkline(cpu, width))
+	fmt.Fprintf(w, "RAM:      %5.1f%% %s\n", ramUsage(info), sparkline(ram, width))
+	fmt.Fprintf(w, "Swap:     %5.1f%%\n", percent(info.TotalSwap-info.FreeSwap, info.TotalSwap))
+	fmt.Fprintf(w, "Process:  PID %d, CPU %.1f%%, RAM %.1f%%\n", info.Proc.Pid,
+		info.Proc.CPU*100, percent(info.Proc.TotalRam, info.TotalRam))
+	fmt.Fprintf(w, "Uptime:   %s\n", info.Uptime)
+	fmt.Fprintf(w, "Last beat: %v ago\n", time.Since(agent.LastBeat).Truncate(time.Millisecond))
+}
+
+// renderTasks writes a row with the id and the age of every task.
+func renderTasks(w io.Writer, tasks []monmq.TaskInfo) {
+	for _, ti := range tasks {
+		fmt.Fprintf(w, "%-40s %v\n", ti.ID, ti.Age().Truncate(time.Second))
+	}
+}
+
+// renderLog writes the last height lines of the command log.
+func renderLog(w io.Writer, lines []string, height int) {
+	if len(lines) > height {
+		lines = lines[len(lines)-height:]
+	}
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+// selectedAgent returns the agent selected by the user.
+func selectedAgent(agents []monmq.Status) (monmq.Status, bool) {
+	name := ui.selection("agents")
+	for _, st := range agents {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	return monmq.Status{}, false
+}
+
+// keepSelection moves the cursor of v to the row selected by the user. Rows
+// are identified by their first field, given in rows, because they move on
+// every update (e.g. when the agents are sorted by CPU usage). If the
+// selected row is no longer shown, the row under the cursor is selected.
+func keepSelection(v *gocui.View, rows []string) error {
+	i := rowIndex(rows, ui.selection(v.Name()))
+	if i < 0 {
+		_, oy := v.Origin()
+		_, cy := v.Cursor()
+		if i = oy + cy; i >= len(rows) {
+			i = len(rows) - 1
+		}
+		if i < 0 {
+			ui.setSelection(v.Name(), "")
+			return nil
+		}
+		ui.setSelection(v.Name(), rows[i])
+	}
+
+	ox, oy := v.Origin()
+	_, height := v.Size()
+	oy = scroll(i, oy, height)
+	if err := v.SetOrigin(ox, oy); err != nil {
+		return err
+	}
+	return v.SetCursor(0, i-oy)
+}
+
+// rowIndex returns the index of field in rows, or -1 if it is not present.
+func rowIndex(rows []string, field string) int {
+	for i, r := range rows {
+		if field != "" && r == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// scroll returns the origin of a view with the given height, currently
+// scrolled to origin, so that row is visible.
+func scroll(row, origin, height int) int {
+	switch {
+	case row < origin:
+		return row
+	case height > 0 && row >= origin+height:
+		return row - height + 1
+	}
+	return origin
+}
+
+// selectedField returns the first field of the line under the cursor of the
+// given view.
+func selectedField(g *gocui.Gui, view string) string {
+	v, err := g.View(view)
+	if err != nil {
+		return ""
+	}
+	_, cy := v.Cursor()
+	line, err := v.Line(cy)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
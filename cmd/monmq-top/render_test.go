@@ -0,0 +1,112 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/monmq"
+)
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		values []float64
+		width  int
+		want   string
+	}{
+		{nil, 10, ""},
+		{[]float64{0, 0.5, 1}, 10, "▁▄█"},
+		{[]float64{-1, 2}, 10, "▁█"},
+		{[]float64{0, 0.5, 1}, 2, "▄█"},
+		{[]float64{0, 0.5, 1}, 0, ""},
+		{[]float64{0, 0.5, 1}, -1, ""},
+	}
+	for _, tt := range tests {
+		if got := sparkline(tt.values, tt.width); got != tt.want {
+			t.Errorf("sparkline(%v, %d) = %q, want %q", tt.values, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestRenderAgents(t *testing.T) {
+	var buf bytes.Buffer
+	st := testAgents[1]
+	st.State = monmq.Running
+	renderAgents(&buf, []monmq.Status{st})
+	fields := strings.Fields(buf.String())
+	want := []string{"w1", "running", "10.0%", "90.0%", "2"}
+	if strings.Join(fields, " ") != strings.Join(want, " ") {
+		t.Errorf("row = %q, want fields %v", buf.String(), want)
+	}
+}
+
+func TestRenderInfo(t *testing.T) {
+	// The sparklines fit in the columns left by the labels.
+	history := []monmq.Status{testAgents[0], testAgents[1], testAgents[2]}
+	var buf bytes.Buffer
+	renderInfo(&buf, 21, testAgents[2], history)
+	out := buf.String()
+	for _, want := range []string{"Name:     x1\n", "CPU:       50.0% ▇▁▄\n", "RAM:       50.0% ▂▇▄\n", "Swap:       0.0%\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("renderInfo output %q does not contain %q", out, want)
+		}
+	}
+}
+
+func TestRenderInfoNarrow(t *testing.T) {
+	history := []monmq.Status{testAgents[0], testAgents[1]}
+	for width := 0; width <= len("CPU:      ")+8; width++ {
+		var buf bytes.Buffer
+		renderInfo(&buf, width, testAgents[1], history)
+		if !strings.Contains(buf.String(), "CPU:       10.0% \n") {
+			t.Errorf("width %d: renderInfo output %q", width, buf.String())
+		}
+	}
+}
+
+func TestRenderLog(t *testing.T) {
+	var buf bytes.Buffer
+	renderLog(&buf, []string{"a", "b", "c"}, 2)
+	if buf.String() != "b\nc\n" {
+		t.Errorf("renderLog = %q, want the last 2 lines", buf.String())
+	}
+}
+
+func TestRowIndex(t *testing.T) {
+	rows := []string{"w2", "x1", "w1"}
+	tests := []struct {
+		field string
+		want  int
+	}{
+		{"w1", 2},
+		{"x1", 1},
+		{"w3", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := rowIndex(rows, tt.field); got != tt.want {
+			t.Errorf("rowIndex(%q) = %d, want %d", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestScroll(t *testing.T) {
+	tests := []struct {
+		row, origin, height, want int
+	}{
+		{3, 0, 10, 0},
+		{3, 5, 10, 3},
+		{12, 0, 10, 3},
+		{12, 5, 10, 5},
+		{12, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := scroll(tt.row, tt.origin, tt.height); got != tt.want {
+			t.Errorf("scroll(%d, %d, %d) = %d, want %d", tt.row, tt.origin, tt.height, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+// sortKeys are the columns the agents table can be sorted by.
+var sortKeys = []string{"name", "cpu", "ram", "tasks"}
+
+// state holds the settings chosen by the user, the selected rows and the
+// command log.
+type state struct {
+	mu       sync.Mutex
+	sortKey  int
+	filter   string
+	selected map[string]string // first field of the selected row of every view
+	log      []string
+}
+
+func newState() *state {
+	return &state{selected: map[string]string{}}
+}
+
+// selection returns the first field of the row selected in the given view,
+// i.e. the name of an agent or the id of a task.
+func (s *state) selection(view string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.selected[view]
+}
+
+func (s *state) setSelection(view, field string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.selected[view] = field
+}
+
+func (s *state) nextSortKey() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sortKey = (s.sortKey + 1) % len(sortKeys)
+}
+
+func (s *state) setFilter(filter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.filter = strings.TrimSpace(filter)
+}
+
+func (s *state) logf(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line := time.Now().Format("15:04:05 ") + fmt.Sprintf(format, args...)
+	s.log = append(s.log, line)
+	if len(s.log) > maxLogLines {
+		s.log = s.log[len(s.log)-maxLogLines:]
+	}
+}
+
+func (s *state) logLines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.log...)
+}
+
+// agents returns the agents that match the filter, sorted by the selected
+// column. It also returns the description of the current settings.
+func (s *state) agents(status []monmq.Status) ([]monmq.Status, string) {
+	s.mu.Lock()
+	key, filter := sortKeys[s.sortKey], s.filter
+	s.mu.Unlock()
+
+	var agents []monmq.Status
+	for _, st := range status {
+		if matches(st, filter) {
+			agents = append(agents, st)
+		}
+	}
+	sort.SliceStable(agents, func(i, j int) bool {
+		a, b := agents[i], agents[j]
+		switch key {
+		case "cpu":
+			return a.Info.CPU > b.Info.CPU
+		case "ram":
+			return ramUsage(a.Info) > ramUsage(b.Info)
+		case "tasks":
+			return len(a.Tasks) > len(b.Tasks)
+		}
+		return a.Name < b.Name
+	})
+
+	desc := "sort: " + key
+	if filter != "" {
+		desc += ", filter: " + filter
+	}
+	return agents, desc
+}
+
+// matches reports whether the agent matches the filter. The filter is
+// either a label selector (key=value) or a substring of the agent name.
+func matches(st monmq.Status, filter string) bool {
+	if kv := strings.SplitN(filter, "=", 2); len(kv) == 2 {
+		return st.Labels[kv[0]] == kv[1]
+	}
+	return strings.Contains(st.Name, filter)
+}
+
+// percent returns used/total as a percentage. It returns 0 if total is 0,
+// e.g. on hosts without swap.
+func percent(used, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total) * 100
+}
+
+func ramUsage(info monmq.SystemInfo) float64 {
+	return percent(info.TotalRam-info.FreeRam, info.TotalRam)
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/monmq"
+)
+
+var testAgents = []monmq.Status{
+	{
+		Name:   "w2",
+		Labels: map[string]string{"role": "crawler"},
+		Info:   monmq.SystemInfo{CPU: 0.9, TotalRam: 100, FreeRam: 80},
+	},
+	{
+		Name:   "w1",
+		Labels: map[string]string{"role": "crawler"},
+		Tasks:  []string{"t1", "t2"},
+		Info:   monmq.SystemInfo{CPU: 0.1, TotalRam: 100, FreeRam: 10},
+	},
+	{
+		Name:   "x1",
+		Labels: map[string]string{"role": "indexer"},
+		Tasks:  []string{"t3"},
+		Info:   monmq.SystemInfo{CPU: 0.5, TotalRam: 100, FreeRam: 50},
+	},
+}
+
+func names(agents []monmq.Status) string {
+	var names []string
+	for _, st := range agents {
+		names = append(names, st.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestStateAgents(t *testing.T) {
+	s := newState()
+	tests := []struct {
+		want, desc string
+	}{
+		{"w1,w2,x1", "sort: name"},
+		{"w2,x1,w1", "sort: cpu"},
+		{"w1,x1,w2", "sort: ram"},
+		{"w1,x1,w2", "sort: tasks"},
+		{"w1,w2,x1", "sort: name"},
+	}
+	for i, tt := range tests {
+		if i > 0 {
+			s.nextSortKey()
+		}
+		agents, desc := s.agents(testAgents)
+		if names(agents) != tt.want || desc != tt.desc {
+			t.Errorf("agents = %s (%s), want %s (%s)", names(agents), desc, tt.want, tt.desc)
+		}
+	}
+
+	for _, tt := range []struct{ filter, want string }{
+		{" w ", "w1,w2"},
+		{"role=indexer", "x1"},
+		{"role=none", ""},
+	} {
+		s.setFilter(tt.filter)
+		agents, desc := s.agents(testAgents)
+		if names(agents) != tt.want || !strings.HasSuffix(desc, "filter: "+strings.TrimSpace(tt.filter)) {
+			t.Errorf("filter %q: agents = %s (%s), want %s", tt.filter, names(agents), desc, tt.want)
+		}
+	}
+}
+
+func TestStateLog(t *testing.T) {
+	s := newState()
+	for i := 0; i < maxLogLines+10; i++ {
+		s.logf("line %d", i)
+	}
+	lines := s.logLines()
+	if len(lines) != maxLogLines {
+		t.Fatalf("len(logLines) = %d, want %d", len(lines), maxLogLines)
+	}
+	if want := fmt.Sprintf("line %d", maxLogLines+9); !strings.HasSuffix(lines[len(lines)-1], want) {
+		t.Errorf("last line = %q, want suffix %q", lines[len(lines)-1], want)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	if p := percent(1, 0); p != 0 {
+		t.Errorf("percent(1, 0) = %v, want 0", p)
+	}
+	if p := ramUsage(testAgents[1].Info); p != 90 {
+		t.Errorf("ramUsage = %v, want 90", p)
+	}
+}
+
+func TestStateSelection(t *testing.T) {
+	s := newState()
+	if sel := s.selection("agents"); sel != "" {
+		t.Errorf("initial selection = %q", sel)
+	}
+	s.setSelection("agents", "w1")
+	s.setSelection("tasks", "t2")
+	if s.selection("agents") != "w1" || s.selection("tasks") != "t2" {
+		t.Errorf("selection = %q, %q", s.selection("agents"), s.selection("tasks"))
+	}
+}
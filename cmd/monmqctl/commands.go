@@ -0,0 +1,164 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+func cmdAgents(s *monmq.Supervisor, args []string) error {
+	if len(args) != 0 {
+		return usageError("agents")
+	}
+	status := s.Status()
+	sort.Sort(byName(status))
+	return format(os.Stdout, status)
+}
+
+func cmdStatus(s *monmq.Supervisor, args []string) error {
+	if len(args) != 1 {
+		return usageError("status <agent>")
+	}
+	for _, st := range s.Status() {
+		if st.Name == args[0] {
+			return format(os.Stdout, st)
+		}
+	}
+	return errNotFound
+}
+
+func cmdTasks(s *monmq.Supervisor, args []string) error {
+	fs := flag.NewFlagSet("tasks", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	agent := fs.String("agent", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return usageError("tasks [-agent name]")
+	}
+	tasks := s.Tasks(func(ti monmq.TaskInfo) bool {
+		return *agent == "" || ti.Agent == *agent
+	})
+	return format(os.Stdout, tasks)
+}
+
+func cmdControl(cmd monmq.Command) func(s *monmq.Supervisor, args []string) error {
+	return func(s *monmq.Supervisor, args []string) error {
+		if len(args) != 1 {
+			return usageError(fmt.Sprintf("%v <selector>", cmd))
+		}
+		targets, err := selectAgents(s, args[0])
+		if err != nil {
+			return err
+		}
+		return invokeAll(s, cmd, targets, nil)
+	}
+}
+
+func cmdShutdown(s *monmq.Supervisor, args []string) error {
+	fs := flag.NewFlagSet("shutdown", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	hard := fs.Bool("hard", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usageError("shutdown [-hard] <selector>")
+	}
+	cmd := monmq.SoftShutdown
+	if *hard {
+		cmd = monmq.HardShutdown
+	}
+	targets, err := selectAgents(s, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return invokeAll(s, cmd, targets, nil)
+}
+
+func cmdKillTask(s *monmq.Supervisor, args []string) error {
+	fs := flag.NewFlagSet("kill-task", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	reason := fs.String("reason", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usageError("kill-task [-reason text] <id>")
+	}
+	return invokeAll(s, monmq.KillTask, fs.Args(), []byte(*reason))
+}
+
+func cmdLogs(s *monmq.Supervisor, args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	n := fs.Int("n", 100, "")
+	since := fs.Duration("since", 0, "")
+	level := fs.String("level", "debug", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usageError("logs [-n lines] [-since d] [-level name] <agent>")
+	}
+	l, err := monmq.ParseLogLevel(*level)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	q := monmq.LogQuery{Lines: *n, Level: l}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	lines, err := s.Logs(fs.Arg(0), q, *timeout)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line.Text)
+	}
+	return nil
+}
+
+func cmdInvoke(s *monmq.Supervisor, args []string) error {
+	fs := flag.NewFlagSet("invoke", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	data := fs.String("args", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return usageError("invoke [-args data] <command> <target>")
+	}
+	cmd, err := monmq.ParseCommand(fs.Arg(0))
+	if err != nil {
+		return usageError(err.Error())
+	}
+	return invokeAll(s, cmd, []string{fs.Arg(1)}, []byte(*data))
+}
+
+func cmdWatch(s *monmq.Supervisor, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	interval := fs.Duration("interval", 2*time.Second, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return usageError("watch [-interval d]")
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	for {
+		select {
+		case <-sig:
+			return nil
+		case <-time.After(*interval):
+			status := s.Status()
+			sort.Sort(byName(status))
+			fmt.Printf("--- %s\n", time.Now().Format(time.RFC3339))
+			if err := format(os.Stdout, status); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type byName []monmq.Status
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
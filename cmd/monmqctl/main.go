@@ -0,0 +1,294 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Monmqctl allows to inspect and control the agents of a monmq deployment.
+
+Usage:
+
+	monmqctl [flags] command [arguments]
+
+The commands are:
+
+	agents                     list the online agents
+	status <agent>             show the status of an agent
+	tasks [-agent name]        list the tasks handled by the agents
+	pause <selector>           pause the selected agents
+	resume <selector>          resume the selected agents
+	shutdown [-hard] <selector>
+	                           shut down the selected agents
+	kill-task [-reason text] <id>
+	                           kill a task
+	logs [-n lines] [-since d] [-level name] <agent>
+	                           show the recent log lines of an agent
+	invoke [-args data] <command> <target>
+	                           invoke any command
+	watch [-interval d]        list the online agents periodically
+
+A selector is an agent name, a shell pattern matching agent names (e.g.
+"worker-*") or a label selector (e.g. "role=crawler").
+
+Agents may require a confirmation for dangerous commands. In that case, the
+command is refused with a token and must be run again with the flag -confirm.
+Tokens are issued per agent, so -confirm can only be used with a selector
+matching a single agent.
+
+Agents may also require signed or encrypted commands. The flags -key and
+-keyid set the key used to sign the commands (see monmq.LoadSigner) and the
+flag -keyring the file with the encryption keys (see monmq.LoadKeyring).
+
+Exit status is 0 on success, 1 if a command fails or an agent does not reply,
+2 on usage errors and 3 if no agent matches.
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+var (
+	broker      = flag.String("broker", "amqp://localhost:5672", "broker URI")
+	exchange    = flag.String("exchange", "mon-exchange", "monitoring exchange")
+	replies     = flag.String("replies", "", "replies queue (default monmqctl-<pid>)")
+	tlsCA       = flag.String("tls-ca", "", "CA certificate file")
+	tlsCert     = flag.String("tls-cert", "", "client certificate file")
+	tlsKey      = flag.String("tls-key", "", "client key file")
+	tlsInsecure = flag.Bool("tls-insecure", false, "skip broker certificate verification")
+	output      = flag.String("o", "table", "output format: table, json or yaml")
+	wait        = flag.Duration("wait", 3*time.Second, "time to wait for agents' heartbeats")
+	timeout     = flag.Duration("timeout", 10*time.Second, "time to wait for command replies")
+	confirm     = flag.String("confirm", "", "token that confirms a command refused by an agent")
+	ttl         = flag.Duration("ttl", 0, "time after which agents refuse the commands (0 means no expiry)")
+	key         = flag.String("key", "", "file with the key used to sign the commands (HMAC secret or Ed25519 PEM private key)")
+	keyID       = flag.String("keyid", "", "id of the signing key")
+	keyring     = flag.String("keyring", "", "file with the encryption keys, one \"id hex-secret [not-before [not-after]]\" per line")
+)
+
+// errNotFound is returned by the commands when no agent or task matches.
+var errNotFound = errors.New("not found")
+
+// usageError is returned by the commands when they are not properly invoked.
+type usageError string
+
+func (e usageError) Error() string { return "usage: monmqctl " + string(e) }
+
+type command struct {
+	run func(s *monmq.Supervisor, args []string) error
+	// heartbeats is true when the command needs the status of the agents.
+	heartbeats bool
+}
+
+var commands = map[string]command{
+	"agents":    {cmdAgents, true},
+	"status":    {cmdStatus, true},
+	"tasks":     {cmdTasks, true},
+	"pause":     {cmdControl(monmq.Pause), true},
+	"resume":    {cmdControl(monmq.Resume), true},
+	"shutdown":  {cmdShutdown, true},
+	"kill-task": {cmdKillTask, true},
+	"logs":      {cmdLogs, false},
+	"invoke":    {cmdInvoke, true},
+	"watch":     {cmdWatch, false},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "monmqctl: unknown command %q\n", flag.Arg(0))
+		usage()
+	}
+	if _, ok := formatters[*output]; !ok {
+		fmt.Fprintf(os.Stderr, "monmqctl: unknown output format %q\n", *output)
+		usage()
+	}
+
+	s, err := newSupervisor()
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+	if cmd.heartbeats {
+		time.Sleep(*wait)
+	}
+	err = cmd.run(s, flag.Args()[1:])
+	s.Shutdown()
+	os.Exit(exitCode(err))
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: monmqctl [flags] command [arguments]")
+	fmt.Fprintln(os.Stderr, "commands: agents, status, tasks, pause, resume, shutdown, kill-task, logs, invoke, watch")
+	fmt.Fprintln(os.Stderr, "flags:")
+	flag.PrintDefaults()
+	os.Exit(exitUsage)
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(os.Stderr, "monmqctl:", err)
+	switch err.(type) {
+	case usageError:
+		return exitUsage
+	}
+	if err == errNotFound || err == monmq.ErrTaskNotFound {
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+func newSupervisor() (*monmq.Supervisor, error) {
+	q := *replies
+	if q == "" {
+		q = fmt.Sprintf("monmqctl-%d", os.Getpid())
+	}
+	s := monmq.NewSupervisor(*broker, q, *exchange)
+	if err := configure(s); err != nil {
+		return nil, err
+	}
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// configure sets up the supervisor from the flags.
+func configure(s *monmq.Supervisor) error {
+	s.Beat = *wait / 3
+	s.CommandTTL = *ttl
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+	s.TLSConfig = tlsConfig
+	if *key != "" {
+		if *keyID == "" {
+			return usageError("-key requires -keyid")
+		}
+		if s.Signer, err = monmq.LoadSigner(*key, *keyID); err != nil {
+			return err
+		}
+	}
+	if *keyring != "" {
+		if s.Keyring, err = monmq.LoadKeyring(*keyring); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	if *tlsCA == "" && *tlsCert == "" && !*tlsInsecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: *tlsInsecure}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *tlsCA)
+		}
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// selectAgents returns the names of the online agents matching the selector.
+func selectAgents(s *monmq.Supervisor, selector string) ([]string, error) {
+	var names []string
+	for _, st := range s.Status() {
+		if kv := strings.SplitN(selector, "=", 2); len(kv) == 2 {
+			if st.Labels[kv[0]] == kv[1] {
+				names = append(names, st.Name)
+			}
+			continue
+		}
+		ok, err := path.Match(selector, st.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, st.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errNotFound
+	}
+	return names, nil
+}
+
+// invokeAll invokes cmd on every target, waiting for their replies. It
+// returns an error if any of the invocations fails. A confirmation token is
+// only valid for the agent that issued it, so -confirm requires a single
+// target.
+func invokeAll(s *monmq.Supervisor, cmd monmq.Command, targets []string, args []byte) error {
+	if *confirm != "" && len(targets) > 1 {
+		return usageError("-confirm requires a selector matching a single agent")
+	}
+	failed := 0
+	for _, target := range targets {
+		var (
+			r   monmq.Reply
+			err error
+		)
+		if *confirm != "" {
+			r, err = s.InvokeConfirmWait(cmd, target, args, *confirm, *timeout)
+		} else {
+			r, err = s.InvokeWait(cmd, target, args, *timeout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v %v: %v\n", cmd, target, err)
+			if r.Refusal != nil && r.Refusal.ConfirmToken != "" {
+				if len(targets) > 1 {
+					fmt.Fprintf(os.Stderr, "run again on %v alone with -confirm %s to confirm\n", target, r.Refusal.ConfirmToken)
+				} else {
+					fmt.Fprintf(os.Stderr, "run again with -confirm %s to confirm\n", r.Refusal.ConfirmToken)
+				}
+			}
+			failed++
+			continue
+		}
+		if len(r.Data) > 0 {
+			fmt.Printf("%v %v: %s\n", cmd, target, r.Data)
+		} else {
+			fmt.Printf("%v %v: ok\n", cmd, target)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d invocations failed", failed, len(targets))
+	}
+	return nil
+}
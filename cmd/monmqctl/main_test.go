@@ -0,0 +1,70 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/monmq"
+)
+
+func TestConfigureKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monmqctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyPath, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyringPath := filepath.Join(dir, "keyring")
+	if err := ioutil.WriteFile(keyringPath, []byte("k1 "+strings.Repeat("01", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		*key, *keyID, *keyring = "", "", ""
+	}()
+
+	flag.Set("key", keyPath)
+	s := monmq.NewSupervisor("", "", "")
+	if err := configure(s); err == nil {
+		t.Error("-key accepted without -keyid")
+	}
+
+	flag.Set("keyid", "ops")
+	flag.Set("keyring", keyringPath)
+	if err := configure(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Signer == nil || s.Signer.KeyID() != "ops" || s.Keyring == nil {
+		t.Fatalf("Signer = %v, Keyring = %v", s.Signer, s.Keyring)
+	}
+
+	// The commands are signed with the loaded key.
+	msg := []byte("Pause w1")
+	sig, err := s.Signer.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (monmq.HMACKey{ID: "ops", Secret: []byte("secret")}).Verify(msg, sig); err != nil {
+		t.Errorf("signature not verified by the agent key: %v", err)
+	}
+}
+
+func TestInvokeAllConfirm(t *testing.T) {
+	defer func() { *confirm = "" }()
+
+	flag.Set("confirm", "token")
+	err := invokeAll(nil, monmq.HardShutdown, []string{"w1", "w2"}, nil)
+	if _, ok := err.(usageError); !ok {
+		t.Errorf("-confirm with several agents: err = %v, want usage error", err)
+	}
+}
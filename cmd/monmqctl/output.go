@@ -0,0 +1,193 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+var formatters = map[string]func(w io.Writer, v interface{}) error{
+	"table": formatTable,
+	"json":  formatJSON,
+	"yaml":  formatYAML,
+}
+
+// format writes v to w using the output format selected by the user.
+func format(w io.Writer, v interface{}) error {
+	return formatters[*output](w, v)
+}
+
+func formatJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func formatTable(w io.Writer, v interface{}) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	switch v := v.(type) {
+	case []monmq.Status:
+		fmt.Fprintln(tw, "NAME\tSTATE\tTASKS\tCPU\tRAM\tLAST BEAT")
+		for _, st := range v {
+			fmt.Fprintf(tw, "%s\t%v\t%d\t%.1f%%\t%.1f%%\t%v\n",
+				st.Name, st.State, len(st.Tasks), st.Info.CPU*100,
+				percent(st.Info.TotalRam-st.Info.FreeRam, st.Info.TotalRam),
+				time.Since(st.LastBeat).Truncate(time.Millisecond))
+		}
+	case monmq.Status:
+		fmt.Fprintf(tw, "Name:\t%s\n", v.Name)
+		fmt.Fprintf(tw, "Labels:\t%s\n", labels(v.Labels))
+		fmt.Fprintf(tw, "State:\t%s\n", v.State)
+		fmt.Fprintf(tw, "State since:\t%v\n", v.StateSince.Format(time.RFC3339))
+		if v.Health != "" {
+			fmt.Fprintf(tw, "Health:\t%s\n", v.Health)
+			for _, name := range healthChecks(v.HealthChecks) {
+				r := v.HealthChecks[name]
+				fmt.Fprintf(tw, "  %s:\t%s %s\n", name, r.Health, r.Error)
+			}
+		}
+		fmt.Fprintf(tw, "Version:\t%s\n", v.Info.Version)
+		fmt.Fprintf(tw, "CPU:\t%.1f%%\n", v.Info.CPU*100)
+		fmt.Fprintf(tw, "RAM:\t%.1f%%\n", percent(v.Info.TotalRam-v.Info.FreeRam, v.Info.TotalRam))
+		fmt.Fprintf(tw, "Swap:\t%.1f%%\n", percent(v.Info.TotalSwap-v.Info.FreeSwap, v.Info.TotalSwap))
+		fmt.Fprintf(tw, "PID:\t%d\n", v.Info.Proc.Pid)
+		fmt.Fprintf(tw, "Process CPU:\t%.1f%%\n", v.Info.Proc.CPU*100)
+		fmt.Fprintf(tw, "Process RAM:\t%.1f%%\n", percent(v.Info.Proc.TotalRam, v.Info.TotalRam))
+		fmt.Fprintf(tw, "Uptime:\t%v\n", v.Info.Uptime)
+		fmt.Fprintf(tw, "Last beat:\t%v\n", time.Since(v.LastBeat).Truncate(time.Millisecond))
+		fmt.Fprintf(tw, "Tasks:\t%s\n", strings.Join(v.Tasks, ", "))
+	case []monmq.TaskInfo:
+		fmt.Fprintln(tw, "ID\tAGENT\tAGE")
+		for _, ti := range v {
+			fmt.Fprintf(tw, "%s\t%s\t%v\n", ti.ID, ti.Agent, ti.Age().Truncate(time.Second))
+		}
+	default:
+		return fmt.Errorf("cannot format %T as table", v)
+	}
+	return tw.Flush()
+}
+
+// percent returns used/total as a percentage. It returns 0 if total is 0.
+func percent(used, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total) * 100
+}
+
+func healthChecks(checks map[string]monmq.HealthCheckResult) []string {
+	var names []string
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func labels(l map[string]string) string {
+	var pairs []string
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// formatYAML writes v to w as YAML. v is converted to JSON first, so the
+// JSON encoding rules apply.
+func formatYAML(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	writeYAML(&sb, generic, 0)
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+func writeYAML(sb *strings.Builder, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			sb.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sb.WriteString(pad + yamlScalar(k) + ":")
+			writeYAMLValue(sb, v[k], indent)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			sb.WriteString(pad + "[]\n")
+			return
+		}
+		for _, e := range v {
+			sb.WriteString(pad + "-")
+			writeYAMLValue(sb, e, indent)
+		}
+	default:
+		sb.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLValue writes the value of a mapping key or a sequence item.
+func writeYAMLValue(sb *strings.Builder, v interface{}, indent int) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			sb.WriteString(" {}\n")
+			return
+		}
+		sb.WriteString("\n")
+		writeYAML(sb, v, indent+1)
+	case []interface{}:
+		if len(v) == 0 {
+			sb.WriteString(" []\n")
+			return
+		}
+		sb.WriteString("\n")
+		writeYAML(sb, v, indent+1)
+	default:
+		sb.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return strconv.Quote(v)
+	default:
+		return strconv.Quote(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatYAML(t *testing.T) {
+	v := map[string]interface{}{
+		"Name":   "w1",
+		"Tasks":  []string{"t1", "t2"},
+		"Labels": map[string]string{},
+		"Info":   map[string]interface{}{"CPU": 0.5, "Proc": map[string]int{"Pid": 42}},
+		"Empty":  nil,
+	}
+	want := `"Empty": null
+"Info":
+  "CPU": 0.5
+  "Proc":
+    "Pid": 42
+"Labels": {}
+"Name": "w1"
+"Tasks":
+  - "t1"
+  - "t2"
+`
+	var buf bytes.Buffer
+	if err := formatYAML(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("formatYAML =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
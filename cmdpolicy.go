@@ -0,0 +1,248 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Refusal reasons.
+const (
+	RefusalDenied               = "denied"
+	RefusalCooldown             = "cooldown"
+	RefusalRateLimited          = "rate limited"
+	RefusalConfirmationRequired = "confirmation required"
+	RefusalInvalidConfirmation  = "invalid confirmation"
+)
+
+// refusalPrefix precedes the JSON encoded refusal in the errors returned by
+// the agents.
+const refusalPrefix = "refused: "
+
+// A Refusal is returned by an agent when a command violates its
+// CommandPolicy.
+type Refusal struct {
+	Agent   string
+	Command Command
+	Target  string
+	Reason  string
+
+	// RetryAfter is the time after which the command would be accepted
+	// again, if the reason is a cooldown or rate limit.
+	RetryAfter time.Duration `json:",omitempty"`
+
+	// ConfirmToken is the token that must be sent to confirm the command
+	// (see Supervisor.InvokeConfirm) if the reason is that a confirmation
+	// is required.
+	ConfirmToken string `json:",omitempty"`
+}
+
+func (r *Refusal) Error() string {
+	msg := fmt.Sprintf("agent %s refused %v on %q: %s", r.Agent, r.Command, r.Target, r.Reason)
+	switch {
+	case r.RetryAfter > 0:
+		msg += fmt.Sprintf(" (retry after %v)", r.RetryAfter)
+	case r.ConfirmToken != "":
+		msg += fmt.Sprintf(" (confirm token %s)", r.ConfirmToken)
+	}
+	return msg
+}
+
+// encode returns the refusal as sent by the agents.
+func (r *Refusal) encode() string {
+	b, _ := json.Marshal(r)
+	return refusalPrefix + string(b)
+}
+
+// parseRefusal returns the refusal contained in an error returned by an
+// agent, if any.
+func parseRefusal(errmsg string) (*Refusal, bool) {
+	i := strings.Index(errmsg, refusalPrefix)
+	if i < 0 {
+		return nil, false
+	}
+	var r Refusal
+	if err := json.Unmarshal([]byte(errmsg[i+len(refusalPrefix):]), &r); err != nil {
+		return nil, false
+	}
+	return &r, true
+}
+
+// A CommandRule limits the invocation of a command in an agent.
+type CommandRule struct {
+	// Deny refuses the command.
+	Deny bool
+
+	// Cooldown is the minimum time between two executions of the
+	// command.
+	Cooldown time.Duration
+
+	// RateLimit is the maximum number of executions of the command during
+	// RateWindow. A value lower than or equal to zero disables the limit.
+	// If RateWindow is zero, RateLimit is the maximum number of executions
+	// since the agent started.
+	RateLimit  int
+	RateWindow time.Duration
+
+	// Confirm requires a two-step invocation. The first one is refused
+	// with a confirm token that must be sent back, along with the same
+	// command, target and arguments, before ConfirmTimeout.
+	Confirm bool
+}
+
+// A CommandPolicy is a local policy enforced by an agent on the commands it
+// receives, regardless of who sent them (see Authorizer). Commands without
+// rule are allowed. Only the commands executed successfully count against
+// the cooldowns and rate limits. A CommandPolicy can be built with
+// NewCommandPolicy or as a literal.
+type CommandPolicy struct {
+	// Rules are the rules indexed by command.
+	Rules map[Command]CommandRule
+
+	// ConfirmTimeout is the validity of the confirm tokens. If it is zero,
+	// 1m is used.
+	ConfirmTimeout time.Duration
+
+	mu       sync.Mutex
+	executed map[Command][]time.Time
+	tokens   map[string]confirmation
+}
+
+// A confirmation is a command waiting for its confirm token.
+type confirmation struct {
+	identity string
+	digest   [sha256.Size]byte
+	expires  time.Time
+}
+
+// NewCommandPolicy returns a CommandPolicy with the given rules.
+func NewCommandPolicy(rules map[Command]CommandRule) *CommandPolicy {
+	return &CommandPolicy{
+		Rules:          rules,
+		ConfirmTimeout: time.Minute,
+		executed:       map[Command][]time.Time{},
+		tokens:         map[string]confirmation{},
+	}
+}
+
+// init initializes the state of policies built as literals. The caller must
+// hold p.mu.
+func (p *CommandPolicy) init() {
+	if p.executed == nil {
+		p.executed = map[Command][]time.Time{}
+	}
+	if p.tokens == nil {
+		p.tokens = map[string]confirmation{}
+	}
+}
+
+// check returns a refusal if the command sent by identity in req violates the
+// policy. The execution of the allowed commands must be recorded with record
+// once they succeed.
+func (p *CommandPolicy) check(identity string, req envelope) *Refusal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rule, ok := p.Rules[req.Cmd]
+	if !ok {
+		return nil
+	}
+	p.init()
+	refuse := func(reason string) *Refusal {
+		return &Refusal{Command: req.Cmd, Target: req.Target, Reason: reason}
+	}
+
+	if rule.Deny {
+		return refuse(RefusalDenied)
+	}
+
+	now := time.Now()
+	executed := p.executed[req.Cmd]
+	if rule.RateLimit > 0 {
+		var recent []time.Time
+		for _, t := range executed {
+			if rule.RateWindow == 0 || now.Sub(t) < rule.RateWindow {
+				recent = append(recent, t)
+			}
+		}
+		executed = recent
+	} else if len(executed) > 1 {
+		executed = executed[len(executed)-1:]
+	}
+	p.executed[req.Cmd] = executed
+	if n := len(executed); rule.Cooldown > 0 && n > 0 {
+		if wait := rule.Cooldown - now.Sub(executed[n-1]); wait > 0 {
+			r := refuse(RefusalCooldown)
+			r.RetryAfter = wait
+			return r
+		}
+	}
+	if rule.RateLimit > 0 && len(executed) >= rule.RateLimit {
+		r := refuse(RefusalRateLimited)
+		if rule.RateWindow > 0 {
+			r.RetryAfter = rule.RateWindow - now.Sub(executed[0])
+		}
+		return r
+	}
+
+	if rule.Confirm {
+		for token, c := range p.tokens {
+			if now.After(c.expires) {
+				delete(p.tokens, token)
+			}
+		}
+		if req.Confirm == "" {
+			token, err := newCommandID()
+			if err != nil {
+				return refuse(RefusalDenied)
+			}
+			timeout := p.ConfirmTimeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+			p.tokens[token] = confirmation{
+				identity: identity,
+				digest:   commandDigest(req),
+				expires:  now.Add(timeout),
+			}
+			r := refuse(RefusalConfirmationRequired)
+			r.ConfirmToken = token
+			return r
+		}
+		c, ok := p.tokens[req.Confirm]
+		if !ok || c.identity != identity || c.digest != commandDigest(req) {
+			return refuse(RefusalInvalidConfirmation)
+		}
+		delete(p.tokens, req.Confirm)
+	}
+	return nil
+}
+
+// record records a successful execution of cmd.
+func (p *CommandPolicy) record(cmd Command) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.Rules[cmd]; !ok {
+		return
+	}
+	p.init()
+	p.executed[cmd] = append(p.executed[cmd], time.Now())
+}
+
+// commandDigest returns the digest of the command, target and arguments of a
+// request, which must not change between the two steps of a confirmation.
+func commandDigest(req envelope) [sha256.Size]byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\x00%s\x00", req.Cmd, req.Target)
+	buf.Write(req.Args)
+	return sha256.Sum256(buf.Bytes())
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+// refusal returns the refusal contained in the error returned by an agent.
+func refusal(t *testing.T, err error) *Refusal {
+	if err == nil {
+		t.Fatal("command not refused")
+	}
+	r, ok := parseRefusal(err.Error())
+	if !ok {
+		t.Fatalf("no refusal in %q", err)
+	}
+	return r
+}
+
+func TestCommandPolicyDenyAndLimits(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.HardShutdownFunc = func(data []byte) ([]byte, error) {
+		return nil, nil
+	}
+	a.Policy = NewCommandPolicy(map[Command]CommandRule{
+		HardShutdown: {Deny: true},
+		Pause:        {RateLimit: 2, RateWindow: time.Minute},
+	})
+
+	_, err := a.invoke("id", encodeInvocation(HardShutdown, "w1", nil))
+	if r := refusal(t, err); r.Reason != RefusalDenied || r.Agent != "w1" || r.Command != HardShutdown {
+		t.Errorf("refusal = %+v", r)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.invoke("id", encodeInvocation(Pause, "w1", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = a.invoke("id", encodeInvocation(Pause, "w1", nil))
+	if r := refusal(t, err); r.Reason != RefusalRateLimited || r.RetryAfter <= 0 || r.RetryAfter > time.Minute {
+		t.Errorf("refusal = %+v", r)
+	}
+	if calls != 2 {
+		t.Errorf("PauseFunc called %d times, want 2", calls)
+	}
+
+	a.Policy.Rules[Pause] = CommandRule{Cooldown: time.Hour}
+	_, err = a.invoke("id", encodeInvocation(Pause, "w1", nil))
+	if r := refusal(t, err); r.Reason != RefusalCooldown || r.RetryAfter <= 59*time.Minute {
+		t.Errorf("refusal = %+v", r)
+	}
+}
+
+func TestCommandPolicyRateLimitWithoutWindow(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.Policy = NewCommandPolicy(map[Command]CommandRule{
+		Pause: {RateLimit: 1},
+	})
+
+	if _, err := a.invoke("id", encodeInvocation(Pause, "w1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.invoke("id", encodeInvocation(Pause, "w1", nil))
+	if r := refusal(t, err); r.Reason != RefusalRateLimited || r.RetryAfter != 0 {
+		t.Errorf("refusal = %+v", r)
+	}
+	if calls != 1 {
+		t.Errorf("PauseFunc called %d times, want 1", calls)
+	}
+}
+
+func TestCommandPolicyLiteral(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	fail := true
+	a.CustomFunc = func(data []byte) ([]byte, error) {
+		if fail {
+			return nil, errors.New("busy")
+		}
+		return nil, nil
+	}
+	a.Policy = &CommandPolicy{Rules: map[Command]CommandRule{
+		CustomCmd: {Cooldown: time.Hour},
+		Pause:     {Confirm: true},
+	}}
+
+	// Failed commands do not count against the cooldown.
+	for i := 0; i < 2; i++ {
+		if _, err := a.invoke("id", encodeInvocation(CustomCmd, "w1", nil)); err == nil || strings.Contains(err.Error(), "refused") {
+			t.Fatalf("invocation %d: error = %v, want handler error", i, err)
+		}
+	}
+	fail = false
+	if _, err := a.invoke("id", encodeInvocation(CustomCmd, "w1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.invoke("id", encodeInvocation(CustomCmd, "w1", nil))
+	if r := refusal(t, err); r.Reason != RefusalCooldown {
+		t.Errorf("refusal = %+v", r)
+	}
+
+	// Confirm tokens use the default timeout.
+	_, err = a.invoke("id", encodeInvocation(Pause, "w1", nil))
+	r := refusal(t, err)
+	if r.Reason != RefusalConfirmationRequired || r.ConfirmToken == "" {
+		t.Fatalf("refusal = %+v", r)
+	}
+	s := NewSupervisor("", "", "")
+	data, err := s.encodeEnvelope(envelope{Cmd: Pause, Target: "w1", Confirm: r.ConfirmToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.invoke("id", data); err != nil {
+		t.Errorf("confirmed command refused: %v", err)
+	}
+}
+
+func TestCommandPolicyConfirm(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.Policy = NewCommandPolicy(map[Command]CommandRule{
+		Pause: {Confirm: true},
+	})
+	s := NewSupervisor("", "", "")
+
+	data, err := s.encodeRequest(Pause, "w1", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.invoke("id", data)
+	r := refusal(t, err)
+	if r.Reason != RefusalConfirmationRequired || r.ConfirmToken == "" {
+		t.Fatalf("refusal = %+v", r)
+	}
+
+	// The token is only valid for the same command and arguments.
+	data, err = s.encodeEnvelope(envelope{Cmd: Pause, Target: "w1", Args: []byte("y"), Confirm: r.ConfirmToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.invoke("id", data)
+	if r := refusal(t, err); r.Reason != RefusalInvalidConfirmation {
+		t.Errorf("refusal = %+v", r)
+	}
+
+	data, err = s.encodeEnvelope(envelope{Cmd: Pause, Target: "w1", Args: []byte("x"), Confirm: r.ConfirmToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.invoke("id", data); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("PauseFunc called %d times, want 1", calls)
+	}
+
+	// Tokens cannot be reused.
+	data, err = s.encodeEnvelope(envelope{Cmd: Pause, Target: "w1", Args: []byte("x"), Confirm: r.ConfirmToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.invoke("id", data)
+	if r := refusal(t, err); r.Reason != RefusalInvalidConfirmation {
+		t.Errorf("refusal = %+v", r)
+	}
+}
+
+func TestRefusalReply(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	ch := make(chan Reply, 1)
+	s.pending["id"] = ch
+	r := &Refusal{Agent: "w1", Command: Pause, Target: "w1", Reason: RefusalDenied}
+	s.route(rpcmq.Result{UUID: "id", Err: "agent w1: " + r.encode()})
+
+	reply := <-ch
+	if reply.Refusal == nil || *reply.Refusal != *r {
+		t.Fatalf("Refusal = %+v, want %+v", reply.Refusal, r)
+	}
+	if !strings.Contains(reply.Err, RefusalDenied) || strings.Contains(reply.Err, "{") {
+		t.Errorf("Err = %q", reply.Err)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package dashboard provides a self-contained web dashboard for a monmq
+supervisor.
+
+The dashboard shows the online agents, the history of their resource usage
+and their tasks, and allows to control them. Its data is served under /api/
+by the httpapi package.
+*/
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/jroimartin/monmq/httpapi"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler returns a http.Handler that serves the dashboard of the
+// supervisor s. Anyone who can reach it can control the agents; use
+// WithAPI to serve an API that authenticates the users.
+func Handler(s httpapi.Supervisor) http.Handler {
+	return WithAPI(httpapi.NewHandler(s))
+}
+
+// WithAPI returns a http.Handler that serves the dashboard using the given
+// API handler (e.g. a httpapi.Handler with Authenticate set).
+func WithAPI(api http.Handler) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", api))
+	mux.Handle("/", http.FileServer(http.FS(files)))
+	return mux
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dashboard
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/monmq"
+)
+
+type fakeSupervisor struct{}
+
+func (fakeSupervisor) Status() []monmq.Status {
+	return []monmq.Status{{Name: "w1", State: monmq.Running}}
+}
+
+func (fakeSupervisor) History(name string) []monmq.Status { return nil }
+
+func (fakeSupervisor) Tasks(filter func(ti monmq.TaskInfo) bool) []monmq.TaskInfo { return nil }
+
+func (fakeSupervisor) Send(inv monmq.Invocation) (string, error) {
+	return "", nil
+}
+
+func TestHandler(t *testing.T) {
+	ts := httptest.NewServer(Handler(fakeSupervisor{}))
+	defer ts.Close()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "<title>monmq</title>"},
+		{"/app.js", "function refresh()"},
+		{"/api/agents", `"Name":"w1"`},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: status code = %d", tt.path, resp.StatusCode)
+		}
+		if !strings.Contains(string(b), tt.want) {
+			t.Errorf("GET %s: missing %q", tt.path, tt.want)
+		}
+	}
+}
+
+func TestInvokeForgery(t *testing.T) {
+	ts := httptest.NewServer(Handler(fakeSupervisor{}))
+	defer ts.Close()
+
+	// A cross-site form can only send text/plain bodies.
+	resp, err := http.Post(ts.URL+"/api/invoke", "text/plain", strings.NewReader(`{"command": "HardShutdown", "target": "w1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("status code = %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
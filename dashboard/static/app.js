@@ -0,0 +1,158 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+'use strict';
+
+const refreshTime = 2000;
+
+let selected = null;
+
+async function api(path, options) {
+	const resp = await fetch('api' + path, options);
+	const body = await resp.json();
+	if (!resp.ok) {
+		throw new Error(body.error);
+	}
+	return body;
+}
+
+function el(tag, attrs, ...children) {
+	const e = document.createElement(tag);
+	Object.assign(e, attrs);
+	e.append(...children);
+	return e;
+}
+
+function percent(v) {
+	return (v * 100).toFixed(1) + '%';
+}
+
+function ratio(used, total) {
+	return total > 0 ? used / total : 0;
+}
+
+function sparkline(values) {
+	const width = 200, height = 30;
+	const ns = 'http://www.w3.org/2000/svg';
+	const svg = document.createElementNS(ns, 'svg');
+	svg.setAttribute('width', width);
+	svg.setAttribute('height', height);
+	if (values.length > 1) {
+		const step = width / (values.length - 1);
+		const points = values.map((v, i) =>
+			(i * step).toFixed(1) + ',' + (height - v * height).toFixed(1));
+		const line = document.createElementNS(ns, 'polyline');
+		line.setAttribute('class', 'sparkline');
+		line.setAttribute('points', points.join(' '));
+		svg.append(line);
+	}
+	return svg;
+}
+
+function confirmed(text) {
+	const dialog = document.getElementById('confirm');
+	document.getElementById('confirm-text').textContent = text;
+	dialog.showModal();
+	return new Promise(resolve => {
+		dialog.addEventListener('close', () => resolve(dialog.returnValue === 'ok'), {once: true});
+	});
+}
+
+async function invoke(command, target) {
+	if (!await confirmed(`Invoke ${command} on ${target}?`)) {
+		return;
+	}
+	try {
+		await api('/invoke', {
+			method: 'POST',
+			headers: {'Content-Type': 'application/json'},
+			body: JSON.stringify({command, target}),
+		});
+	} catch (err) {
+		alert(`${command} ${target}: ${err.message}`);
+	}
+}
+
+function renderAgents(agents) {
+	const list = document.getElementById('agent-list');
+	list.replaceChildren(...agents.map(agent => {
+		const state = agent.State;
+		const li = el('li', {className: agent.Name === selected ? 'selected' : ''},
+			el('span', {}, agent.Name),
+			el('span', {className: 'badge ' + state}, state));
+		li.addEventListener('click', () => {
+			selected = agent.Name;
+			refresh();
+		});
+		return li;
+	}));
+
+	const running = agents.filter(a => a.State === 'running').length;
+	document.getElementById('summary').textContent =
+		`${agents.length} agents, ${running} running`;
+}
+
+function renderDetails(agent, history, tasks) {
+	const details = document.getElementById('details');
+	if (!agent) {
+		details.replaceChildren(el('p', {className: 'empty'}, 'Select an agent.'));
+		return;
+	}
+
+	const info = agent.Info;
+	const cpu = history.map(st => st.Info.CPU);
+	const ram = history.map(st => ratio(st.Info.TotalRam - st.Info.FreeRam, st.Info.TotalRam));
+
+	const controls = ['Pause', 'Resume', 'SoftShutdown', 'HardShutdown'].map(cmd => {
+		const b = el('button', {className: cmd === 'HardShutdown' ? 'danger' : ''}, cmd);
+		b.addEventListener('click', () => invoke(cmd, agent.Name));
+		return b;
+	});
+
+	const rows = tasks.map(task => {
+		const kill = el('button', {className: 'danger'}, 'Kill');
+		kill.addEventListener('click', () => invoke('KillTask', task.ID));
+		const age = Math.round((Date.now() - Date.parse(task.Start)) / 1000);
+		return el('tr', {}, el('td', {}, task.ID), el('td', {}, age + 's'), el('td', {}, kill));
+	});
+
+	details.replaceChildren(
+		el('h2', {}, agent.Name),
+		el('p', {}, ...controls),
+		el('p', {}, `Version: ${info.Version}`),
+		el('p', {}, `CPU usage: ${percent(info.CPU)} `, sparkline(cpu)),
+		el('p', {}, `RAM usage: ${percent(ratio(info.TotalRam - info.FreeRam, info.TotalRam))} `, sparkline(ram)),
+		el('p', {}, `Swap usage: ${percent(ratio(info.TotalSwap - info.FreeSwap, info.TotalSwap))}`),
+		el('p', {}, `Process: PID ${info.Proc.Pid}, CPU ${percent(info.Proc.CPU)}, ` +
+			`RAM ${percent(ratio(info.Proc.TotalRam, info.TotalRam))}`),
+		el('h3', {}, 'Tasks'),
+		rows.length > 0 ?
+			el('table', {}, el('tr', {}, el('th', {}, 'ID'), el('th', {}, 'Age'), el('th')), ...rows) :
+			el('p', {className: 'empty'}, 'No tasks.'));
+}
+
+async function refresh() {
+	try {
+		const agents = await api('/agents');
+		agents.sort((a, b) => a.Name.localeCompare(b.Name));
+		renderAgents(agents);
+
+		const agent = agents.find(a => a.Name === selected);
+		if (!agent) {
+			renderDetails(null);
+			return;
+		}
+		const name = encodeURIComponent(agent.Name);
+		const [history, tasks] = await Promise.all([
+			api(`/agents/${name}/history`),
+			api(`/tasks?agent=${name}`),
+		]);
+		renderDetails(agent, history, tasks);
+	} catch (err) {
+		document.getElementById('summary').textContent = err.message;
+	}
+}
+
+refresh();
+setInterval(refresh, refreshTime);
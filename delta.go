@@ -0,0 +1,195 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// statusDelta contains the changes between two status updates of an agent.
+// Base is the sequence number of the update the delta applies to, so it is
+// never zero.
+type statusDelta struct {
+	Name string
+	Seq  uint64
+	Base uint64
+
+	// Set holds the top-level fields that have been replaced.
+	Set map[string]json.RawMessage `json:",omitempty"`
+
+	// Patch holds the changes of the top-level fields that are JSON
+	// objects (e.g. Info or TaskStart).
+	Patch map[string]objectPatch `json:",omitempty"`
+
+	TasksAdded   []string `json:",omitempty"`
+	TasksRemoved []string `json:",omitempty"`
+}
+
+type objectPatch struct {
+	Set map[string]json.RawMessage `json:",omitempty"`
+	Del []string                   `json:",omitempty"`
+}
+
+var errDeltaBase = errors.New("delta base not found")
+
+// isDelta reports whether the GetStatus response data contains a delta
+// instead of a full snapshot.
+func isDelta(data []byte) bool {
+	var d struct{ Base uint64 }
+	if err := json.Unmarshal(data, &d); err != nil {
+		return false
+	}
+	return d.Base != 0
+}
+
+// diffStatus returns the delta between the JSON encoded status old and cur.
+func diffStatus(old, cur []byte) (statusDelta, error) {
+	var oldFields, curFields map[string]json.RawMessage
+	if err := json.Unmarshal(old, &oldFields); err != nil {
+		return statusDelta{}, err
+	}
+	if err := json.Unmarshal(cur, &curFields); err != nil {
+		return statusDelta{}, err
+	}
+
+	d := statusDelta{
+		Set:   map[string]json.RawMessage{},
+		Patch: map[string]objectPatch{},
+	}
+	for k, v := range curFields {
+		ov, ok := oldFields[k]
+		switch {
+		case ok && bytes.Equal(ov, v):
+			continue
+		case ok && k == "Tasks":
+			added, removed, err := diffTasks(ov, v)
+			if err != nil {
+				return statusDelta{}, err
+			}
+			d.TasksAdded, d.TasksRemoved = added, removed
+		case ok && isObject(ov) && isObject(v):
+			p, err := diffObject(ov, v)
+			if err != nil {
+				return statusDelta{}, err
+			}
+			d.Patch[k] = p
+		default:
+			d.Set[k] = v
+		}
+	}
+	return d, nil
+}
+
+// applyDelta applies the delta d to the JSON encoded status old.
+func applyDelta(old []byte, d statusDelta) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(old, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range d.Set {
+		fields[k] = v
+	}
+	for k, p := range d.Patch {
+		obj := map[string]json.RawMessage{}
+		if isObject(fields[k]) {
+			if err := json.Unmarshal(fields[k], &obj); err != nil {
+				return nil, err
+			}
+		}
+		for _, dk := range p.Del {
+			delete(obj, dk)
+		}
+		for pk, pv := range p.Set {
+			obj[pk] = pv
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		fields[k] = b
+	}
+	if len(d.TasksAdded) > 0 || len(d.TasksRemoved) > 0 {
+		var tasks []string
+		if err := json.Unmarshal(fields["Tasks"], &tasks); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(patchTasks(tasks, d.TasksAdded, d.TasksRemoved))
+		if err != nil {
+			return nil, err
+		}
+		fields["Tasks"] = b
+	}
+	return json.Marshal(fields)
+}
+
+func diffTasks(old, cur json.RawMessage) (added, removed []string, err error) {
+	var oldTasks, curTasks []string
+	if err := json.Unmarshal(old, &oldTasks); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(cur, &curTasks); err != nil {
+		return nil, nil, err
+	}
+	oldSet := map[string]bool{}
+	for _, t := range oldTasks {
+		oldSet[t] = true
+	}
+	curSet := map[string]bool{}
+	for _, t := range curTasks {
+		curSet[t] = true
+		if !oldSet[t] {
+			added = append(added, t)
+		}
+	}
+	for _, t := range oldTasks {
+		if !curSet[t] {
+			removed = append(removed, t)
+		}
+	}
+	return added, removed, nil
+}
+
+func patchTasks(tasks, added, removed []string) []string {
+	del := map[string]bool{}
+	for _, t := range removed {
+		del[t] = true
+	}
+	patched := []string{}
+	for _, t := range tasks {
+		if !del[t] {
+			patched = append(patched, t)
+		}
+	}
+	return append(patched, added...)
+}
+
+func diffObject(old, cur json.RawMessage) (objectPatch, error) {
+	var oldObj, curObj map[string]json.RawMessage
+	if err := json.Unmarshal(old, &oldObj); err != nil {
+		return objectPatch{}, err
+	}
+	if err := json.Unmarshal(cur, &curObj); err != nil {
+		return objectPatch{}, err
+	}
+	p := objectPatch{Set: map[string]json.RawMessage{}}
+	for k, v := range curObj {
+		if ov, ok := oldObj[k]; !ok || !bytes.Equal(ov, v) {
+			p.Set[k] = v
+		}
+	}
+	for k := range oldObj {
+		if _, ok := curObj[k]; !ok {
+			p.Del = append(p.Del, k)
+		}
+	}
+	return p, nil
+}
+
+func isObject(v json.RawMessage) bool {
+	v = bytes.TrimSpace(v)
+	return len(v) > 0 && v[0] == '{'
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	start := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+	old := Status{
+		Name:      "a",
+		Labels:    map[string]string{"role": "crawler"},
+		State:     Running,
+		Tasks:     []string{"t1", "t2"},
+		TaskStart: map[string]time.Time{"t1": start, "t2": start},
+		Info:      SystemInfo{Version: "Linux version 4.0", CPU: 0.1, FreeRam: 10},
+		Seq:       1,
+	}
+	cur := old
+	cur.State = Paused
+	cur.Tasks = []string{"t2", "t3"}
+	cur.TaskStart = map[string]time.Time{"t2": start, "t3": start.Add(time.Minute)}
+	cur.Info.CPU = 0.5
+	cur.Seq = 2
+
+	oldb, err := json.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	curb, err := json.Marshal(cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := diffStatus(oldb, curb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Set["Labels"]; ok {
+		t.Error("unchanged Labels included in delta")
+	}
+	if _, ok := d.Patch["Info"].Set["Version"]; ok {
+		t.Error("unchanged Info.Version included in delta")
+	}
+	if !reflect.DeepEqual(d.TasksAdded, []string{"t3"}) || !reflect.DeepEqual(d.TasksRemoved, []string{"t1"}) {
+		t.Errorf("TasksAdded = %v, TasksRemoved = %v", d.TasksAdded, d.TasksRemoved)
+	}
+
+	b, err := applyDelta(oldb, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Status
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cur) {
+		t.Errorf("applyDelta = %+v, want %+v", got, cur)
+	}
+}
+
+func TestSupervisorDeltaUpdates(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	a := NewAgent("", "", "a")
+	a.DeltaUpdates = true
+
+	for i := 0; i < 3; i++ {
+		if i == 1 {
+			a.RegisterTask("t1")
+		}
+		acks, err := s.acks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := a.getStatus(acks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta := isDelta(b); delta != (i > 0) {
+			t.Errorf("update %d: isDelta = %v", i, delta)
+		}
+		if err := s.handleGetStatus(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := s.Status()
+	if len(status) != 1 || status[0].Seq != 3 || !reflect.DeepEqual(status[0].Tasks, []string{"t1"}) {
+		t.Errorf("Status = %+v", status)
+	}
+
+	// A delta whose base is unknown must be rejected.
+	b, _, err := a.statusUpdate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.handleGetStatus(b); err != errDeltaBase {
+		t.Errorf("handleGetStatus error = %v, want %v", err, errDeltaBase)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import "time"
+
+// DrainStatus reports the progress of the drain of an agent after a
+// SoftShutdown command.
+type DrainStatus struct {
+	// Start is the time at which the drain started and Deadline the time
+	// at which it will be stopped even if there are remaining tasks. A
+	// zero Deadline means that there is no deadline.
+	Start    time.Time
+	Deadline time.Time `json:",omitempty"`
+
+	// Total is the number of tasks when the drain started and Remaining
+	// the number of tasks that have not finished yet.
+	Total     int
+	Remaining int
+
+	// Expired is true if the deadline expired before all the tasks
+	// finished.
+	Expired bool `json:",omitempty"`
+}
+
+// Drained returns a channel that is closed when the drain started by a
+// SoftShutdown command completes, either because all the registered tasks
+// finished, the DrainTimeout expired or the agent was stopped by other means
+// (e.g. HardShutdown).
+func (a *Agent) Drained() <-chan struct{} {
+	return a.drained
+}
+
+// startDrain records the beginning of the drain and waits in the background
+// for the registered tasks to finish.
+func (a *Agent) startDrain() {
+	now := time.Now()
+	var deadline <-chan time.Time
+
+	a.mu.Lock()
+	ds := &DrainStatus{
+		Start:     now,
+		Total:     len(a.status.Tasks),
+		Remaining: len(a.status.Tasks),
+	}
+	if a.DrainTimeout > 0 {
+		ds.Deadline = now.Add(a.DrainTimeout)
+		deadline = time.After(a.DrainTimeout)
+	}
+	a.status.Drain = ds
+	a.mu.Unlock()
+
+	go a.drain(deadline)
+}
+
+func (a *Agent) drain(deadline <-chan time.Time) {
+	defer close(a.drained)
+
+	for {
+		a.mu.RLock()
+		state, remaining := a.status.State, len(a.status.Tasks)
+		a.mu.RUnlock()
+
+		if state != Draining {
+			// Stopped by other means.
+			return
+		}
+		if remaining == 0 {
+			break
+		}
+		select {
+		case <-a.wake:
+		case <-deadline:
+			logf("drain deadline expired with %d remaining tasks", remaining)
+			a.mu.Lock()
+			a.status.Drain.Expired = true
+			a.mu.Unlock()
+			if _, err := a.transition([]State{Draining}, Stopped); err != nil {
+				logf("drain: %v", err)
+			}
+			return
+		}
+	}
+	if _, err := a.transition([]State{Draining}, Stopped); err != nil {
+		logf("drain: %v", err)
+	}
+}
+
+// notify wakes up the drain goroutine, if any.
+func (a *Agent) notify() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"testing"
+	"time"
+)
+
+func waitDrained(t *testing.T, a *Agent) {
+	select {
+	case <-a.Drained():
+	case <-time.After(time.Second):
+		t.Fatal("drain not completed")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.SoftShutdownFunc = func(data []byte) ([]byte, error) {
+		return nil, nil
+	}
+	a.RegisterTask("t1")
+	a.RegisterTask("t2")
+
+	if _, err := a.invoke("id", encodeInvocation(SoftShutdown, "w1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if a.State() != Draining {
+		t.Fatalf("state = %s, want %s", a.State(), Draining)
+	}
+	if err := a.RemoveTask("t1"); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.RLock()
+	ds := *a.status.Drain
+	a.mu.RUnlock()
+	if ds.Total != 2 || ds.Remaining != 1 || !ds.Deadline.IsZero() {
+		t.Errorf("Drain = %+v", ds)
+	}
+	select {
+	case <-a.Drained():
+		t.Fatal("drain completed with remaining tasks")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := a.RemoveTask("t2"); err != nil {
+		t.Fatal(err)
+	}
+	waitDrained(t, a)
+	if a.State() != Stopped {
+		t.Errorf("state = %s, want %s", a.State(), Stopped)
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.SoftShutdownFunc = func(data []byte) ([]byte, error) {
+		return nil, nil
+	}
+	a.DrainTimeout = 10 * time.Millisecond
+	a.RegisterTask("t1")
+
+	if _, err := a.invoke("id", encodeInvocation(SoftShutdown, "w1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	waitDrained(t, a)
+	if a.State() != Stopped || !a.status.Drain.Expired || a.status.Drain.Remaining != 1 {
+		t.Errorf("state = %s, Drain = %+v", a.State(), a.status.Drain)
+	}
+}
+
+func TestDrainAborted(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.SoftShutdownFunc = func(data []byte) ([]byte, error) {
+		return nil, nil
+	}
+	a.HardShutdownFunc = a.SoftShutdownFunc
+	a.RegisterTask("t1")
+
+	if _, err := a.invoke("id", encodeInvocation(SoftShutdown, "w1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.invoke("id", encodeInvocation(HardShutdown, "w1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	waitDrained(t, a)
+	if a.State() != Stopped {
+		t.Errorf("state = %s, want %s", a.State(), Stopped)
+	}
+}
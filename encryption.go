@@ -0,0 +1,268 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sealedMarker is the first byte of the encrypted messages. It is neither a
+// command nor the envelope marker, so encrypted messages can be told apart.
+const sealedMarker = 0xff
+
+// Additional data bound to the encrypted messages, which prevents a request
+// from being reflected as a reply and vice versa.
+var (
+	adRequest = []byte("monmq request")
+	adReply   = []byte("monmq reply")
+)
+
+var (
+	// ErrNoKey is returned when there is no valid key to encrypt or
+	// decrypt a message.
+	ErrNoKey = errors.New("no valid encryption key")
+
+	// ErrDecrypt is returned when an encrypted message cannot be
+	// decrypted.
+	ErrDecrypt = errors.New("cannot decrypt message")
+
+	// ErrNotEncrypted is returned when an agent with a Keyring receives a
+	// plaintext command.
+	ErrNotEncrypted = errors.New("command not encrypted")
+)
+
+// A Key is a shared AES key used to encrypt the messages exchanged between
+// supervisors and agents. Secret must be 16, 24 or 32 bytes long.
+type Key struct {
+	ID     string
+	Secret []byte
+
+	// NotBefore is the time from which the key is used to encrypt
+	// messages. A zero value means that the key is valid since ever.
+	NotBefore time.Time
+
+	// NotAfter is the time from which the key is no longer used to
+	// encrypt nor decrypt messages. A zero value means that the key does
+	// not expire.
+	NotAfter time.Time
+}
+
+func (k Key) expired(t time.Time) bool {
+	return !k.NotAfter.IsZero() && !t.Before(k.NotAfter)
+}
+
+// A Keyring holds the keys shared by supervisors and agents. Messages are
+// encrypted with the valid key with the most recent NotBefore and decrypted
+// with the key they were encrypted with, as long as it has not expired. So,
+// keys can be rotated by adding the new key to every keyring, with a NotBefore
+// in the future, before the old one expires.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []Key
+}
+
+// NewKeyring returns a Keyring with the given keys.
+func NewKeyring(keys ...Key) *Keyring {
+	return &Keyring{keys: append([]Key(nil), keys...)}
+}
+
+// LoadKeyring returns a Keyring with the keys stored in the file at path.
+// Every line contains the id of a key, its hex encoded secret and,
+// optionally, its NotBefore and NotAfter times in RFC 3339 format, separated
+// by spaces. Empty lines and lines starting with # are ignored.
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kr := NewKeyring()
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		k, err := parseKey(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		kr.Add(k)
+	}
+	return kr, sc.Err()
+}
+
+func parseKey(fields []string) (Key, error) {
+	if len(fields) < 2 || len(fields) > 4 {
+		return Key{}, errors.New("malformed key")
+	}
+	secret, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return Key{}, err
+	}
+	if _, err := aes.NewCipher(secret); err != nil {
+		return Key{}, err
+	}
+	k := Key{ID: fields[0], Secret: secret}
+	if len(fields) > 2 {
+		if k.NotBefore, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+			return Key{}, err
+		}
+	}
+	if len(fields) > 3 {
+		if k.NotAfter, err = time.Parse(time.RFC3339, fields[3]); err != nil {
+			return Key{}, err
+		}
+	}
+	return k, nil
+}
+
+// Add adds a key to the keyring, replacing the key with the same id if any.
+func (kr *Keyring) Add(k Key) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for i, old := range kr.keys {
+		if old.ID == k.ID {
+			kr.keys[i] = k
+			return
+		}
+	}
+	kr.keys = append(kr.keys, k)
+}
+
+// Remove removes the key with the given id.
+func (kr *Keyring) Remove(id string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for i, k := range kr.keys {
+		if k.ID == id {
+			kr.keys = append(kr.keys[:i], kr.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// current returns the key used to encrypt messages at time t.
+func (kr *Keyring) current(t time.Time) (Key, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	var (
+		cur   Key
+		found bool
+	)
+	for _, k := range kr.keys {
+		if k.expired(t) || k.NotBefore.After(t) {
+			continue
+		}
+		if !found || !k.NotBefore.Before(cur.NotBefore) {
+			cur, found = k, true
+		}
+	}
+	if !found {
+		return Key{}, ErrNoKey
+	}
+	return cur, nil
+}
+
+// lookup returns the key with the given id if it is valid to decrypt messages
+// at time t. NotBefore is not checked, so messages encrypted by peers with
+// skewed clocks can be decrypted during a rotation.
+func (kr *Keyring) lookup(id string, t time.Time) (Key, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	for _, k := range kr.keys {
+		if k.ID == id && !k.expired(t) {
+			return k, nil
+		}
+	}
+	return Key{}, ErrNoKey
+}
+
+// sealed is the JSON encoded content of an encrypted message.
+type sealed struct {
+	KeyID string
+	Nonce []byte
+	Data  []byte
+}
+
+// seal encrypts data with the current key.
+func (kr *Keyring) seal(data, ad []byte) ([]byte, error) {
+	k, err := kr.current(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(k)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(sealed{
+		KeyID: k.ID,
+		Nonce: nonce,
+		Data:  aead.Seal(nil, nonce, data, ad),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{sealedMarker}, b...), nil
+}
+
+// open decrypts a message encrypted with seal.
+func (kr *Keyring) open(data, ad []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return nil, ErrDecrypt
+	}
+	var msg sealed
+	if err := json.Unmarshal(data[1:], &msg); err != nil {
+		return nil, ErrDecrypt
+	}
+	k, err := kr.lookup(msg.KeyID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Nonce) != aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	b, err := aead.Open(nil, msg.Nonce, msg.Data, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return b, nil
+}
+
+func newAEAD(k Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// isSealed reports whether data is an encrypted message.
+func isSealed(data []byte) bool {
+	return len(data) > 0 && data[0] == sealedMarker
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+func TestEncryptedCommand(t *testing.T) {
+	key := Key{ID: "k1", Secret: bytes.Repeat([]byte{1}, 32)}
+	s := NewSupervisor("", "", "")
+	s.Keyring = NewKeyring(key)
+	data, err := s.encodeRequest(CustomCmd, "w1", []byte("secret-task"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(data) || bytes.Contains(data, []byte("secret-task")) {
+		t.Fatalf("request not encrypted: %q", data)
+	}
+
+	a := NewAgent("", "", "w1")
+	a.Keyring = NewKeyring(key)
+	a.CustomFunc = func(data []byte) ([]byte, error) {
+		return append([]byte("done "), InvocationArgs(data)...), nil
+	}
+	reply, err := a.invoke("id", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(reply) || bytes.Contains(reply, []byte("done")) {
+		t.Fatalf("reply not encrypted: %q", reply)
+	}
+
+	ch := make(chan Reply, 1)
+	s.pending["id"] = ch
+	s.CustomResults = make(chan []byte, 1)
+	if err := s.route(rpcmq.Result{UUID: "id", Data: reply}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-ch; r.Command != CustomCmd || string(r.Data) != "done secret-task" {
+		t.Errorf("reply = %+v", r)
+	}
+}
+
+func TestEncryptionRejected(t *testing.T) {
+	key := Key{ID: "k1", Secret: bytes.Repeat([]byte{1}, 32)}
+	other := Key{ID: "k1", Secret: bytes.Repeat([]byte{2}, 32)}
+
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.Keyring = NewKeyring(key)
+
+	// Commands that cannot be decrypted are ignored because their target
+	// is unknown.
+	tests := []struct {
+		keyring *Keyring
+		wantErr error
+	}{
+		{nil, ErrNotEncrypted},
+		{NewKeyring(other), nil},
+		{NewKeyring(Key{ID: "k2", Secret: key.Secret}), nil},
+	}
+	for i, tt := range tests {
+		s := NewSupervisor("", "", "")
+		s.Keyring = tt.keyring
+		data, err := s.encodeRequest(Pause, "w1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := a.invoke("id", data)
+		if tt.wantErr == nil {
+			if reply != nil || err != nil {
+				t.Errorf("test %d: invoke = %q, %v, want no reply", i, reply, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr.Error()) {
+			t.Errorf("test %d: error = %v, want %v", i, err, tt.wantErr)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("PauseFunc called %d times, want 0", calls)
+	}
+
+	a.AllowPlaintext = true
+	if _, err := a.invoke("id", encodeInvocation(Pause, "w1", nil)); err != nil {
+		t.Errorf("plaintext command: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	oldKey := Key{ID: "old", Secret: bytes.Repeat([]byte{1}, 16), NotAfter: now.Add(time.Hour)}
+	newKey := Key{ID: "new", Secret: bytes.Repeat([]byte{2}, 16), NotBefore: now.Add(time.Minute)}
+	kr := NewKeyring(oldKey, newKey)
+
+	tests := []struct {
+		t      time.Time
+		wantID string
+	}{
+		{now, "old"},
+		{now.Add(2 * time.Minute), "new"},
+		{now.Add(2 * time.Hour), "new"},
+	}
+	for _, tt := range tests {
+		k, err := kr.current(tt.t)
+		if err != nil || k.ID != tt.wantID {
+			t.Errorf("current(%v) = %q, %v, want %q", tt.t, k.ID, err, tt.wantID)
+		}
+	}
+
+	// Messages encrypted with the new key can be decrypted before its
+	// NotBefore, and old messages while the old key is valid.
+	data, err := kr.seal([]byte("msg"), adReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := NewKeyring(newKey, oldKey)
+	if b, err := peer.open(data, adReply); err != nil || string(b) != "msg" {
+		t.Errorf("open = %q, %v", b, err)
+	}
+	if _, err := peer.open(data, adRequest); err != ErrDecrypt {
+		t.Errorf("open with wrong additional data: %v, want %v", err, ErrDecrypt)
+	}
+	peer.Remove("old")
+	if _, err := peer.open(data, adReply); err != ErrNoKey {
+		t.Errorf("open with removed key: %v, want %v", err, ErrNoKey)
+	}
+}
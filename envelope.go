@@ -0,0 +1,265 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// envelopeMarker is the first byte of the requests that carry a JSON encoded
+// envelope. Requests in the legacy format start with the command, so they can
+// be told apart.
+const envelopeMarker = '{'
+
+// signedReplyMarker is the first byte of the replies signed by the agents.
+const signedReplyMarker = 0xfe
+
+var (
+	// ErrExpired is returned when an agent receives a command after its
+	// TTL or after Agent.MaxCommandAge, and when a supervisor receives a
+	// signed reply after Supervisor.MaxReplyAge.
+	ErrExpired = errors.New("command expired")
+
+	// ErrReplayed is returned when an agent receives a command that has
+	// already been received, and when a supervisor receives a signed reply
+	// that has already been received or belongs to another request.
+	ErrReplayed = errors.New("command replayed")
+
+	errMissingID = errors.New("missing command id")
+)
+
+// An envelope wraps a command sent by a supervisor to the agents along with
+// the metadata needed to authenticate it.
+type envelope struct {
+	Cmd    Command
+	Target string
+	Args   []byte `json:",omitempty"`
+
+	// ID uniquely identifies the command, so the agents can detect
+	// replays.
+	ID       string        `json:",omitempty"`
+	IssuedAt time.Time     `json:",omitempty"`
+	TTL      time.Duration `json:",omitempty"`
+
+	// Confirm is the token that confirms a command refused by the
+	// CommandPolicy of the agent.
+	Confirm string `json:",omitempty"`
+
+	// issuer is recorded in the audit trail of the supervisor. It is not
+	// sent to the agents.
+	issuer string
+
+	KeyID string   `json:",omitempty"`
+	Certs [][]byte `json:",omitempty"`
+	Sig   []byte   `json:",omitempty"`
+}
+
+// signedPayload returns the data covered by the signature of the envelope.
+func (e envelope) signedPayload() ([]byte, error) {
+	e.Sig = nil
+	return json.Marshal(e)
+}
+
+func (e *envelope) sign(signer Signer) error {
+	e.KeyID = signer.KeyID()
+	if cs, ok := signer.(certSigner); ok {
+		e.Certs = cs.Certificates()
+	}
+	payload, err := e.signedPayload()
+	if err != nil {
+		return err
+	}
+	e.Sig, err = signer.Sign(payload)
+	return err
+}
+
+// verify checks the signature of the envelope using the certificate chain it
+// carries or the verifier with the same key id. Certificates must have the
+// organizational unit ou, unless it is empty.
+func (e envelope) verify(keys []Verifier, roots *x509.CertPool, ou string) error {
+	payload, err := e.signedPayload()
+	if err != nil {
+		return err
+	}
+	return verifySignature(payload, e.KeyID, e.Certs, e.Sig, keys, roots, ou)
+}
+
+// A certSigner is a Signer whose signatures are verified with a certificate
+// chain sent along with the message.
+type certSigner interface {
+	Signer
+	Certificates() [][]byte
+}
+
+// verifySignature checks that sig is a valid signature of payload made by
+// keyID. If certs is not empty, it must be a certificate chain issued by one
+// of roots, whose leaf has the organizational unit ou unless it is empty;
+// otherwise, the verifier with the same key id is used.
+func verifySignature(payload []byte, keyID string, certs [][]byte, sig []byte, keys []Verifier, roots *x509.CertPool, ou string) error {
+	if sig == nil {
+		return ErrUnsigned
+	}
+	if len(certs) > 0 {
+		if roots == nil {
+			return ErrUntrustedCert
+		}
+		return verifyCert(certs, roots, ou, keyID, payload, sig)
+	}
+	for _, k := range keys {
+		if k.KeyID() == keyID {
+			return k.Verify(payload, sig)
+		}
+	}
+	return ErrUnknownKey
+}
+
+// A signedReply wraps the reply of an agent along with its signature, which
+// allows the supervisors to authenticate the agents. ID and IssuedAt are
+// signed, so the replies cannot be replayed (see Supervisor.MaxReplyAge).
+type signedReply struct {
+	Data []byte
+
+	// ID is the id of the request the reply belongs to or, for the
+	// pushed status, a random id.
+	ID       string
+	IssuedAt time.Time
+
+	KeyID string
+	Certs [][]byte `json:",omitempty"`
+	Sig   []byte   `json:",omitempty"`
+}
+
+func (r signedReply) signedPayload() ([]byte, error) {
+	r.Sig = nil
+	return json.Marshal(r)
+}
+
+// signReply returns the reply data to the request with the given id signed by
+// signer.
+func signReply(id string, data []byte, signer Signer) ([]byte, error) {
+	r := signedReply{Data: data, ID: id, IssuedAt: time.Now(), KeyID: signer.KeyID()}
+	if cs, ok := signer.(certSigner); ok {
+		r.Certs = cs.Certificates()
+	}
+	payload, err := r.signedPayload()
+	if err != nil {
+		return nil, err
+	}
+	if r.Sig, err = signer.Sign(payload); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{signedReplyMarker}, b...), nil
+}
+
+// isSignedReply reports whether data is a reply signed by an agent.
+func isSignedReply(data []byte) bool {
+	return len(data) > 0 && data[0] == signedReplyMarker
+}
+
+// verifyReply checks the signature of a reply signed by an agent. The identity
+// of the agent is the KeyID of the returned reply.
+func verifyReply(data []byte, keys []Verifier, roots *x509.CertPool) (signedReply, error) {
+	var r signedReply
+	if !isSignedReply(data) || json.Unmarshal(data[1:], &r) != nil {
+		return signedReply{}, errors.New("malformed response")
+	}
+	payload, err := r.signedPayload()
+	if err != nil {
+		return signedReply{}, err
+	}
+	if err := verifySignature(payload, r.KeyID, r.Certs, r.Sig, keys, roots, ""); err != nil {
+		return signedReply{}, err
+	}
+	return r, nil
+}
+
+// expired reports whether the command must not be executed at time now. Commands
+// are valid during their TTL and never longer than maxAge. skew is the
+// tolerated difference between the clocks of the supervisor and the agent.
+func (e envelope) expired(now time.Time, maxAge, skew time.Duration) bool {
+	if e.IssuedAt.IsZero() {
+		return true
+	}
+	if e.IssuedAt.After(now.Add(skew)) {
+		return true
+	}
+	age := now.Sub(e.IssuedAt)
+	if e.TTL > 0 && age > e.TTL+skew {
+		return true
+	}
+	return maxAge > 0 && age > maxAge+skew
+}
+
+// encodeRequest returns the data sent to the agents to invoke cmd on target.
+// If the supervisor has a Signer or a CommandTTL, the request is sent in an
+// envelope with a unique id and the time at which it was issued; otherwise
+// the legacy format is used. The request is encrypted if the supervisor has a
+// Keyring.
+func (s *Supervisor) encodeRequest(cmd Command, target string, args []byte) ([]byte, error) {
+	return s.encodeEnvelope(envelope{Cmd: cmd, Target: target, Args: args})
+}
+
+// encodeEnvelope is like encodeRequest but it takes the command, target,
+// arguments and confirm token from e. The legacy format is only used if
+// there is no confirm token.
+func (s *Supervisor) encodeEnvelope(e envelope) ([]byte, error) {
+	data, err := s.marshalEnvelope(e)
+	if err != nil || s.Keyring == nil {
+		return data, err
+	}
+	return s.Keyring.seal(data, adRequest)
+}
+
+func (s *Supervisor) marshalEnvelope(e envelope) ([]byte, error) {
+	if s.Signer == nil && s.CommandTTL <= 0 && e.Confirm == "" {
+		return encodeInvocation(e.Cmd, e.Target, e.Args), nil
+	}
+	id, err := newCommandID()
+	if err != nil {
+		return nil, err
+	}
+	e.ID, e.IssuedAt, e.TTL = id, time.Now().UTC(), s.CommandTTL
+	if s.Signer != nil {
+		if err := e.sign(s.Signer); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(e)
+}
+
+// newCommandID returns a random id for a command.
+func newCommandID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// decodeRequest decodes the data sent by a supervisor in any of the supported
+// formats.
+func decodeRequest(data []byte) (envelope, error) {
+	if len(data) > 0 && data[0] == envelopeMarker {
+		var e envelope
+		if err := json.Unmarshal(data, &e); err != nil {
+			return envelope{}, errors.New("malformed request")
+		}
+		return e, nil
+	}
+	cmd, target, args, err := decodeInvocation(data)
+	if err != nil {
+		return envelope{}, err
+	}
+	return envelope{Cmd: cmd, Target: target, Args: args}, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// EventType is the type of the events emitted by the supervisor.
+type EventType string
+
+const (
+	// EventOnline is emitted when a new agent is seen. Status contains
+	// its full status.
+	EventOnline EventType = "online"
+
+	// EventStatus is emitted when a new status update is received from an
+	// online agent. Delta contains the changes since the previous update.
+	EventStatus EventType = "status"
+
+	// EventHealth is emitted when the health of an online agent changes.
+	// Status contains the new status of the agent.
+	EventHealth EventType = "health"
+
+	// EventOffline is emitted when an agent is considered offline.
+	EventOffline EventType = "offline"
+
+	// EventReply is emitted when an agent replies to a command.
+	EventReply EventType = "reply"
+
+	// EventReset is only sent to the subscribers that resume a
+	// subscription after events that are no longer kept. Those events
+	// are lost, so the subscriber must fetch the current status of the
+	// agents again. Its sequence number is the one of the last lost
+	// event.
+	EventReset EventType = "reset"
+)
+
+// An Event describes something that happened in the supervisor.
+type Event struct {
+	// Seq is the sequence number of the event. It increases by one for
+	// every event emitted.
+	Seq  uint64
+	Time time.Time
+	Type EventType
+
+	// Agent and Labels identify the agent the event refers to. They are
+	// empty for reply events.
+	Agent  string            `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+
+	Status *Status         `json:",omitempty"`
+	Delta  json.RawMessage `json:",omitempty"`
+	Reply  *Reply          `json:",omitempty"`
+}
+
+// eventHub keeps the recent events and the subscriptions.
+type eventHub struct {
+	mu     sync.Mutex
+	seq    uint64
+	recent []Event
+	subs   map[chan Event]bool
+	size   int
+}
+
+func newEventHub(size int) *eventHub {
+	return &eventHub{subs: make(map[chan Event]bool), size: size}
+}
+
+func (h *eventHub) emit(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	e.Seq = h.seq
+	e.Time = time.Now()
+	h.recent = append(h.recent, e)
+	if n := len(h.recent) - h.size; n > 0 {
+		h.recent = h.recent[n:]
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// Slow subscriber. Closing the channel lets it know
+			// that events were lost, so it can resubscribe.
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *eventHub) subscribe(since uint64) (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, h.size+subscriptionBuffer+1)
+	if since > 0 {
+		oldest := h.seq + 1
+		if len(h.recent) > 0 {
+			oldest = h.recent[0].Seq
+		}
+		// The sequence number is greater than the last one if the
+		// supervisor was restarted.
+		if since+1 < oldest || since > h.seq {
+			since = oldest - 1
+			ch <- Event{Seq: since, Time: time.Now(), Type: EventReset}
+		}
+		for _, e := range h.recent {
+			if e.Seq > since {
+				ch <- e
+			}
+		}
+	}
+	h.subs[ch] = true
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if h.subs[ch] {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+const (
+	// eventBuffer is the number of recent events kept by the supervisor.
+	eventBuffer = 1000
+
+	// subscriptionBuffer is the number of live events that can be queued
+	// for a subscriber.
+	subscriptionBuffer = 256
+)
+
+// Subscribe returns a channel that receives the events emitted by the
+// supervisor. If since is greater than zero, the recent events with a greater
+// sequence number are received first, which allows to resume a subscription.
+// Only the last 1000 events are kept; if older events were requested, an
+// EventReset is received first. The channel is closed when the returned
+// function is called or if the subscriber does not keep up with the events.
+func (s *Supervisor) Subscribe(since uint64) (<-chan Event, func()) {
+	return s.events.subscribe(since)
+}
+
+// emitStatusEvents emits the events corresponding to the replacement of the
+// status old by cur.
+func (s *Supervisor) emitStatusEvents(old, cur []Status) {
+	prev := make(map[string]Status, len(old))
+	for _, st := range old {
+		prev[st.Name] = st
+	}
+	for _, st := range cur {
+		p, ok := prev[st.Name]
+		delete(prev, st.Name)
+		if !ok {
+			st := st
+			s.events.emit(Event{Type: EventOnline, Agent: st.Name, Labels: st.Labels, Status: &st})
+			continue
+		}
+		if p.LastBeat.Equal(st.LastBeat) {
+			continue
+		}
+		delta, err := statusChanges(p, st)
+		if err != nil {
+			logf("status event: %v", err)
+			continue
+		}
+		s.events.emit(Event{Type: EventStatus, Agent: st.Name, Labels: st.Labels, Delta: delta})
+		if p.Health != st.Health {
+			st := st
+			s.events.emit(Event{Type: EventHealth, Agent: st.Name, Labels: st.Labels, Status: &st})
+		}
+	}
+	for _, st := range prev {
+		s.events.emit(Event{Type: EventOffline, Agent: st.Name, Labels: st.Labels})
+	}
+}
+
+// statusChanges returns the JSON encoded delta between two status.
+func statusChanges(old, cur Status) (json.RawMessage, error) {
+	oldb, err := json.Marshal(old)
+	if err != nil {
+		return nil, err
+	}
+	curb, err := json.Marshal(cur)
+	if err != nil {
+		return nil, err
+	}
+	d, err := diffStatus(oldb, curb)
+	if err != nil {
+		return nil, err
+	}
+	d.Name, d.Seq, d.Base = cur.Name, cur.Seq, old.Seq
+	return json.Marshal(d)
+}
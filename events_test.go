@@ -0,0 +1,95 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+func TestEvents(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	events, cancel := s.Subscribe(0)
+	defer cancel()
+
+	heartbeat(t, s, Status{Name: "a", Seq: 1})
+	heartbeat(t, s, Status{Name: "a", Seq: 2, Tasks: []string{"t1"}})
+	s.route(rpcmq.Result{UUID: "id", Data: []byte{byte(Pause)}})
+	s.Timeout = 0
+	time.Sleep(time.Millisecond)
+	s.prune()
+
+	want := []EventType{EventOnline, EventStatus, EventReply, EventOffline}
+	for i, typ := range want {
+		e := <-events
+		if e.Type != typ || e.Seq != uint64(i+1) {
+			t.Fatalf("event %d = %v (seq %d), want %v", i, e.Type, e.Seq, typ)
+		}
+		switch e.Type {
+		case EventOnline:
+			if e.Agent != "a" || e.Status == nil || e.Status.Seq != 1 {
+				t.Errorf("online event = %+v", e)
+			}
+		case EventStatus:
+			var d statusDelta
+			if err := json.Unmarshal(e.Delta, &d); err != nil {
+				t.Fatal(err)
+			}
+			if d.Base != 1 || d.Seq != 2 || len(d.TasksAdded) != 1 {
+				t.Errorf("status event delta = %+v", d)
+			}
+		case EventReply:
+			if e.Reply == nil || e.Reply.ID != "id" || e.Reply.Command != Pause {
+				t.Errorf("reply event = %+v", e)
+			}
+		}
+	}
+
+	// Resume after the second event.
+	resumed, cancel := s.Subscribe(2)
+	defer cancel()
+	if e := <-resumed; e.Seq != 3 {
+		t.Errorf("first resumed event seq = %d, want 3", e.Seq)
+	}
+}
+
+func TestEventsReset(t *testing.T) {
+	h := newEventHub(2)
+	for i := 0; i < 5; i++ {
+		h.emit(Event{Type: EventReply})
+	}
+
+	tests := []struct {
+		since     uint64
+		wantReset bool
+		wantSeqs  []uint64
+	}{
+		{3, false, []uint64{4, 5}},
+		{2, true, []uint64{3, 4, 5}},
+		{1, true, []uint64{3, 4, 5}},
+		// The supervisor was restarted.
+		{9, true, []uint64{3, 4, 5}},
+	}
+	for _, tt := range tests {
+		ch, cancel := h.subscribe(tt.since)
+		var seqs []uint64
+		reset := false
+		for len(ch) > 0 {
+			e := <-ch
+			if e.Type == EventReset {
+				reset = true
+			}
+			seqs = append(seqs, e.Seq)
+		}
+		cancel()
+		if reset != tt.wantReset || fmt.Sprint(seqs) != fmt.Sprint(tt.wantSeqs) {
+			t.Errorf("since %d: reset = %v, seqs = %v, want %v, %v", tt.since, reset, seqs, tt.wantReset, tt.wantSeqs)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrHealthCheckInterval is returned by AddHealthCheck if the interval or
+// the timeout of the check are not positive.
+var ErrHealthCheckInterval = errors.New("health check interval and timeout must be positive")
+
+// ErrDegraded can be wrapped by the errors returned by the health checks to
+// report that the agent is degraded instead of unhealthy.
+var ErrDegraded = errors.New("degraded")
+
+// Health is the result of the health checks of an agent.
+type Health string
+
+const (
+	Healthy   Health = "healthy"
+	Degraded  Health = "degraded"
+	Unhealthy Health = "unhealthy"
+)
+
+// worse reports whether h is worse than other.
+func (h Health) worse(other Health) bool {
+	rank := map[Health]int{Healthy: 0, Degraded: 1, Unhealthy: 2}
+	return rank[h] > rank[other]
+}
+
+// A HealthCheckFunc probes a dependency of the agent (e.g. a database). It
+// returns an error if the dependency is not healthy. Errors wrapping
+// ErrDegraded make the agent degraded; any other error or a timeout makes
+// it unhealthy.
+type HealthCheckFunc func(ctx context.Context) error
+
+// HealthCheckResult is the result of the last execution of a health check.
+type HealthCheckResult struct {
+	Health   Health
+	Error    string `json:",omitempty"`
+	Checked  time.Time
+	Duration time.Duration
+}
+
+// AddHealthCheck registers a health check that is executed every interval.
+// If it does not return within timeout, the check fails. The result of every
+// check is reported in Status.HealthChecks and the worst of them in
+// Status.Health. The check is executed for the first time immediately and
+// until the agent is shut down. Both interval and timeout must be greater
+// than zero; otherwise, ErrHealthCheckInterval is returned.
+func (a *Agent) AddHealthCheck(name string, fn HealthCheckFunc, interval, timeout time.Duration) error {
+	if interval <= 0 || timeout <= 0 {
+		return ErrHealthCheckInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			a.runHealthCheck(name, fn, timeout)
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) runHealthCheck(name string, fn HealthCheckFunc, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fn(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := HealthCheckResult{Health: Healthy, Checked: start, Duration: time.Since(start)}
+	if err != nil {
+		res.Health, res.Error = Unhealthy, err.Error()
+		if errors.Is(err, ErrDegraded) {
+			res.Health = Degraded
+		}
+		logf("health check %s: %v", name, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.status.HealthChecks == nil {
+		a.status.HealthChecks = make(map[string]HealthCheckResult)
+	}
+	a.status.HealthChecks[name] = res
+	health := Healthy
+	for _, r := range a.status.HealthChecks {
+		if r.Health.worse(health) {
+			health = r.Health
+		}
+	}
+	a.status.Health = health
+}
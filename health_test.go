@@ -0,0 +1,120 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func agentHealth(a *Agent) Status {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	st := a.status
+	st.HealthChecks = make(map[string]HealthCheckResult)
+	for name, r := range a.status.HealthChecks {
+		st.HealthChecks[name] = r
+	}
+	return st
+}
+
+func TestHealthChecks(t *testing.T) {
+	a := NewAgent("", "", "w1")
+
+	var dbErr error
+	db := func(ctx context.Context) error { return dbErr }
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}
+
+	tests := []struct {
+		err  error
+		want Health
+	}{
+		{nil, Healthy},
+		{fmt.Errorf("replica lag: %w", ErrDegraded), Degraded},
+		{errors.New("connection refused"), Unhealthy},
+		{nil, Healthy},
+	}
+	for _, tt := range tests {
+		dbErr = tt.err
+		a.runHealthCheck("db", db, time.Second)
+		st := agentHealth(a)
+		if st.Health != tt.want || st.HealthChecks["db"].Health != tt.want {
+			t.Errorf("check error %v: Health = %s, HealthChecks = %+v, want %s", tt.err, st.Health, st.HealthChecks, tt.want)
+		}
+	}
+
+	// A check that does not return in time makes the agent unhealthy.
+	a.runHealthCheck("cache", hang, 10*time.Millisecond)
+	st := agentHealth(a)
+	if st.Health != Unhealthy || st.HealthChecks["db"].Health != Healthy {
+		t.Errorf("Health = %s, HealthChecks = %+v", st.Health, st.HealthChecks)
+	}
+	if r := st.HealthChecks["cache"]; r.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("timed out check error = %q", r.Error)
+	}
+
+	if got := HealthIs(Degraded, Unhealthy)(st); len(got) != 1 || got[0] != "w1" {
+		t.Errorf("HealthIs = %v", got)
+	}
+}
+
+func TestAddHealthCheck(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	check := func(ctx context.Context) error { return nil }
+	if err := a.AddHealthCheck("db", check, 0, time.Second); err != ErrHealthCheckInterval {
+		t.Errorf("zero interval: error = %v, want %v", err, ErrHealthCheckInterval)
+	}
+	if err := a.AddHealthCheck("db", check, time.Second, -time.Second); err != ErrHealthCheckInterval {
+		t.Errorf("negative timeout: error = %v, want %v", err, ErrHealthCheckInterval)
+	}
+
+	calls := make(chan bool, 10)
+	count := func(ctx context.Context) error {
+		select {
+		case calls <- true:
+		default:
+		}
+		return nil
+	}
+	if err := a.AddHealthCheck("db", count, 5*time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-calls:
+		case <-time.After(time.Second):
+			t.Fatalf("check executed %d times", i)
+		}
+	}
+	close(a.done)
+}
+
+func TestHealthEvents(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	events, cancel := s.Subscribe(0)
+	defer cancel()
+
+	heartbeat(t, s, Status{Name: "a", Seq: 1, Health: Healthy})
+	heartbeat(t, s, Status{Name: "a", Seq: 2, Health: Healthy})
+	heartbeat(t, s, Status{Name: "a", Seq: 3, Health: Unhealthy})
+
+	want := []EventType{EventOnline, EventStatus, EventStatus, EventHealth}
+	for i, typ := range want {
+		e := <-events
+		if e.Type != typ {
+			t.Fatalf("event %d = %v, want %v", i, e.Type, typ)
+		}
+		if e.Type == EventHealth && (e.Status == nil || e.Status.Health != Unhealthy) {
+			t.Errorf("health event = %+v", e)
+		}
+	}
+}
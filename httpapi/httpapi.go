@@ -0,0 +1,298 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package httpapi exposes a monmq supervisor over a HTTP/JSON API.
+
+The following endpoints are available:
+
+	GET  /agents                 status of the online agents
+	GET  /agents/{name}          status of the given agent
+	GET  /agents/{name}/history  last status updates of the given agent
+	GET  /tasks                  tasks handled by the online agents
+	POST /invoke                 invoke a command
+
+The agents can be filtered with the query parameters "name" (prefix),
+"state" (e.g. paused, can be repeated), "running" (true or false, whether the
+state is running), "health" (healthy, degraded or unhealthy, can be repeated)
+and "label" (key=value, can be repeated). The tasks can be filtered by
+"agent".
+
+The body of the invoke requests is a JSON object like the following one:
+
+	{"command": "Pause", "target": "worker-17", "args": "optional data"}
+
+The invoke requests must have the Content-Type application/json and, if they
+are sent by a browser, an Origin matching the Host of the request (see
+Handler.CheckOrigin), so other sites cannot invoke commands through the
+browsers of the users. They are authenticated by Handler.Authenticate, if
+set, and the commands are recorded in the audit trail of the supervisor on
+behalf of the authenticated user.
+
+Errors are reported with the corresponding status code and a JSON body:
+
+	{"error": "description"}
+*/
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/monmq"
+)
+
+// Supervisor is the interface that must be implemented by the supervisor
+// exposed by the API. It is satisfied by *monmq.Supervisor.
+type Supervisor interface {
+	Status() []monmq.Status
+	History(name string) []monmq.Status
+	Tasks(filter func(ti monmq.TaskInfo) bool) []monmq.TaskInfo
+	Send(inv monmq.Invocation) (string, error)
+}
+
+// Handler is a http.Handler that serves the API.
+type Handler struct {
+	s   Supervisor
+	mux *http.ServeMux
+
+	// Authenticate, if not nil, checks the credentials of the requests
+	// that invoke commands and returns the identity of the user, which is
+	// recorded as the issuer of the commands (see monmq.Invocation). If
+	// it returns an error, the request is refused with status 401. If
+	// Authenticate is nil, no issuer is recorded, so the audit trail only
+	// contains the key id of the supervisor.
+	Authenticate func(r *http.Request) (string, error)
+
+	// CheckOrigin reports whether the invoke requests with the given
+	// Origin header are allowed. If it is nil, only the requests whose
+	// Origin matches their Host, and the ones without Origin (which are
+	// not sent by browsers), are allowed.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// NewHandler returns a Handler that exposes the supervisor s.
+func NewHandler(s Supervisor) *Handler {
+	h := &Handler{s: s, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /agents", h.agents)
+	h.mux.HandleFunc("GET /agents/{name}", h.agent)
+	h.mux.HandleFunc("GET /agents/{name}/history", h.history)
+	h.mux.HandleFunc("GET /tasks", h.tasks)
+	h.mux.HandleFunc("POST /invoke", h.invoke)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// InvokeRequest is the body of the invoke requests.
+type InvokeRequest struct {
+	Command string `json:"command"`
+	Target  string `json:"target"`
+	Args    string `json:"args,omitempty"`
+}
+
+// InvokeResponse is the body of the response to a successful invoke request.
+type InvokeResponse struct {
+	ID string `json:"id"`
+}
+
+// Error is the body of the error responses.
+type Error struct {
+	Error string `json:"error"`
+}
+
+func (h *Handler) agents(w http.ResponseWriter, r *http.Request) {
+	filter, err := agentFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	status := []monmq.Status{}
+	for _, st := range h.s.Status() {
+		if filter(st) {
+			status = append(status, st)
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (h *Handler) agent(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	for _, st := range h.s.Status() {
+		if st.Name == name {
+			writeJSON(w, http.StatusOK, st)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, errors.New("agent not found"))
+}
+
+func (h *Handler) history(w http.ResponseWriter, r *http.Request) {
+	history := h.s.History(r.PathValue("name"))
+	if len(history) == 0 {
+		writeError(w, http.StatusNotFound, errors.New("agent not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (h *Handler) tasks(w http.ResponseWriter, r *http.Request) {
+	agent := r.URL.Query().Get("agent")
+	tasks := h.s.Tasks(func(ti monmq.TaskInfo) bool {
+		return agent == "" || ti.Agent == agent
+	})
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+func (h *Handler) invoke(w http.ResponseWriter, r *http.Request) {
+	if ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || ct != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return
+	}
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		writeError(w, http.StatusForbidden, errors.New("origin not allowed"))
+		return
+	}
+	var issuer string
+	if h.Authenticate != nil {
+		var err error
+		if issuer, err = h.Authenticate(r); err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+	}
+
+	var req InvokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cmd, err := monmq.ParseCommand(req.Command)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Target == "" && cmd != monmq.GetStatus {
+		writeError(w, http.StatusBadRequest, errors.New("missing target"))
+		return
+	}
+	id, err := h.s.Send(monmq.Invocation{
+		Command: cmd,
+		Target:  req.Target,
+		Args:    []byte(req.Args),
+		Issuer:  issuer,
+	})
+	switch {
+	case err == monmq.ErrTaskNotFound:
+		writeError(w, http.StatusNotFound, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, InvokeResponse{ID: id})
+}
+
+// sameOrigin reports whether the Origin header of the request, if any,
+// matches its Host header.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// agentFilter returns a function that reports whether an agent matches the
+// filters in the query of r.
+func agentFilter(r *http.Request) (func(st monmq.Status) bool, error) {
+	q := r.URL.Query()
+
+	name := q.Get("name")
+
+	var running *bool
+	if v := q.Get("running"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("invalid running filter")
+		}
+		running = &b
+	}
+
+	states := q["state"]
+	health := q["health"]
+
+	labels := map[string]string{}
+	for _, l := range q["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid label filter")
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return func(st monmq.Status) bool {
+		if !strings.HasPrefix(st.Name, name) {
+			return false
+		}
+		if running != nil && (st.State == monmq.Running) != *running {
+			return false
+		}
+		if len(states) > 0 && !containsState(states, st.State) {
+			return false
+		}
+		if len(health) > 0 && !containsHealth(health, st.Health) {
+			return false
+		}
+		for k, v := range labels {
+			if st.Labels[k] != v {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func containsState(states []string, s monmq.State) bool {
+	for _, v := range states {
+		if monmq.State(v) == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHealth(health []string, h monmq.Health) bool {
+	for _, v := range health {
+		if monmq.Health(v) == h {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, Error{Error: err.Error()})
+}
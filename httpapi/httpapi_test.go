@@ -0,0 +1,285 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/monmq"
+)
+
+var _ Supervisor = (*monmq.Supervisor)(nil)
+
+type invocation struct {
+	cmd    monmq.Command
+	target string
+	args   string
+	issuer string
+}
+
+type fakeSupervisor struct {
+	status  []monmq.Status
+	tasks   []monmq.TaskInfo
+	invoked []invocation
+}
+
+func (s *fakeSupervisor) Status() []monmq.Status { return s.status }
+
+func (s *fakeSupervisor) History(name string) []monmq.Status {
+	var history []monmq.Status
+	for _, st := range s.status {
+		if st.Name == name {
+			history = append(history, st)
+		}
+	}
+	return history
+}
+
+func (s *fakeSupervisor) Tasks(filter func(ti monmq.TaskInfo) bool) []monmq.TaskInfo {
+	var tasks []monmq.TaskInfo
+	for _, ti := range s.tasks {
+		if filter(ti) {
+			tasks = append(tasks, ti)
+		}
+	}
+	return tasks
+}
+
+func (s *fakeSupervisor) Send(inv monmq.Invocation) (string, error) {
+	if inv.Command == monmq.KillTask {
+		return "", monmq.ErrTaskNotFound
+	}
+	s.invoked = append(s.invoked, invocation{inv.Command, inv.Target, string(inv.Args), inv.Issuer})
+	return "uuid", nil
+}
+
+func newTestServer() (*httptest.Server, *fakeSupervisor) {
+	s := &fakeSupervisor{
+		status: []monmq.Status{
+			{Name: "w1", State: monmq.Running, Labels: map[string]string{"role": "crawler"}},
+			{Name: "w2", State: monmq.Paused, Health: monmq.Degraded, Labels: map[string]string{"role": "crawler"}},
+			{Name: "x1", State: monmq.Running, Health: monmq.Healthy, Labels: map[string]string{"role": "indexer"}},
+		},
+		tasks: []monmq.TaskInfo{{ID: "t1", Agent: "w1"}, {ID: "t2", Agent: "x1"}},
+	}
+	return httptest.NewServer(NewHandler(s)), s
+}
+
+func getJSON(t *testing.T, url string, wantCode int, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != wantCode {
+		t.Fatalf("GET %s: status code = %d, want %d", url, resp.StatusCode, wantCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgents(t *testing.T) {
+	ts, _ := newTestServer()
+	defer ts.Close()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"w1", "w2", "x1"}},
+		{"?name=w", []string{"w1", "w2"}},
+		{"?running=true", []string{"w1", "x1"}},
+		{"?label=role=crawler&running=false", []string{"w2"}},
+		{"?state=paused&state=stopped", []string{"w2"}},
+		{"?health=degraded&health=unhealthy", []string{"w2"}},
+	}
+	for _, tt := range tests {
+		var status []monmq.Status
+		getJSON(t, ts.URL+"/agents"+tt.query, http.StatusOK, &status)
+		var names []string
+		for _, st := range status {
+			names = append(names, st.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("GET /agents%s = %v, want %v", tt.query, names, tt.want)
+		}
+	}
+
+	var e Error
+	getJSON(t, ts.URL+"/agents?running=maybe", http.StatusBadRequest, &e)
+	if e.Error == "" {
+		t.Error("missing error description")
+	}
+}
+
+func TestAgent(t *testing.T) {
+	ts, _ := newTestServer()
+	defer ts.Close()
+
+	var st monmq.Status
+	getJSON(t, ts.URL+"/agents/w2", http.StatusOK, &st)
+	if st.Name != "w2" {
+		t.Errorf("Name = %q, want w2", st.Name)
+	}
+
+	var history []monmq.Status
+	getJSON(t, ts.URL+"/agents/w2/history", http.StatusOK, &history)
+	if len(history) != 1 {
+		t.Errorf("len(history) = %d, want 1", len(history))
+	}
+
+	var e Error
+	getJSON(t, ts.URL+"/agents/unknown", http.StatusNotFound, &e)
+}
+
+func TestTasks(t *testing.T) {
+	ts, _ := newTestServer()
+	defer ts.Close()
+
+	var tasks []monmq.TaskInfo
+	getJSON(t, ts.URL+"/tasks?agent=x1", http.StatusOK, &tasks)
+	if len(tasks) != 1 || tasks[0].ID != "t2" {
+		t.Errorf("tasks = %+v", tasks)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	ts, s := newTestServer()
+	defer ts.Close()
+
+	tests := []struct {
+		body     string
+		wantCode int
+	}{
+		{`{"command": "pause", "target": "w1"}`, http.StatusAccepted},
+		{`{"command": "CustomCmd", "target": "w1", "args": "data"}`, http.StatusAccepted},
+		{`{"command": "KillTask", "target": "t9"}`, http.StatusNotFound},
+		{`{"command": "Explode", "target": "w1"}`, http.StatusBadRequest},
+		{`{"command": "Pause"}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(ts.URL+"/invoke", "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("POST /invoke %s: status code = %d, want %d", tt.body, resp.StatusCode, tt.wantCode)
+		}
+	}
+
+	want := []invocation{{monmq.Pause, "w1", "", ""}, {monmq.CustomCmd, "w1", "data", ""}}
+	if len(s.invoked) != len(want) || s.invoked[0] != want[0] || s.invoked[1] != want[1] {
+		t.Errorf("invoked = %v, want %v", s.invoked, want)
+	}
+}
+
+func TestInvokeIssuer(t *testing.T) {
+	ts, s := newTestServer()
+	defer ts.Close()
+
+	post := func() {
+		req, err := http.NewRequest("POST", ts.URL+"/invoke", strings.NewReader(`{"command": "Pause", "target": "w1"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("alice", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Unchecked credentials are not recorded.
+	post()
+	ts.Config.Handler.(*Handler).Authenticate = func(r *http.Request) (string, error) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || pass != "secret" {
+			return "", errors.New("invalid credentials")
+		}
+		return "sso:" + user, nil
+	}
+	post()
+
+	if len(s.invoked) != 2 || s.invoked[0].issuer != "" || s.invoked[1].issuer != "sso:alice" {
+		t.Errorf("invoked = %+v", s.invoked)
+	}
+}
+
+func TestInvokeForgery(t *testing.T) {
+	ts, s := newTestServer()
+	defer ts.Close()
+
+	h := ts.Config.Handler.(*Handler)
+	h.Authenticate = func(r *http.Request) (string, error) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			return "", errors.New("invalid credentials")
+		}
+		return "ops", nil
+	}
+
+	body := `{"command": "HardShutdown", "target": "w1"}`
+	tests := []struct {
+		contentType string
+		origin      string
+		auth        string
+		wantCode    int
+	}{
+		{"text/plain", "", "Bearer token", http.StatusUnsupportedMediaType},
+		{"", "", "Bearer token", http.StatusUnsupportedMediaType},
+		{"application/json", "https://evil.example.com", "Bearer token", http.StatusForbidden},
+		{"application/json", "", "", http.StatusUnauthorized},
+		{"application/json", "", "Bearer token", http.StatusAccepted},
+		{"application/json; charset=utf-8", ts.URL, "Bearer token", http.StatusAccepted},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest("POST", ts.URL+"/invoke", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range map[string]string{"Content-Type": tt.contentType, "Origin": tt.origin, "Authorization": tt.auth} {
+			if v != "" {
+				req.Header.Set(k, v)
+			}
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("test %d: status code = %d, want %d", i, resp.StatusCode, tt.wantCode)
+		}
+	}
+	if len(s.invoked) != 2 {
+		t.Errorf("invoked = %+v, want 2 invocations", s.invoked)
+	}
+
+	h.CheckOrigin = func(r *http.Request) bool { return r.Header.Get("Origin") == "https://ops.example.com" }
+	req, err := http.NewRequest("POST", ts.URL+"/invoke", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://ops.example.com")
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("allowed origin: status code = %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+var (
+	// ErrUntrustedCert is returned when a message is signed with a
+	// certificate that is not issued by any of the trusted CAs.
+	ErrUntrustedCert = errors.New("untrusted certificate")
+
+	// ErrIdentityMismatch is returned by the supervisors when an agent
+	// reports a name different from the identity in its certificate or
+	// key id.
+	ErrIdentityMismatch = errors.New("identity does not match agent name")
+)
+
+// A CertSigner signs messages with the private key of a certificate, usually
+// the client certificate used to connect to the broker (see TLSConfig). The
+// certificate chain is sent along with the signature, so the peers can verify
+// it against their trusted CAs and derive the identity of the signer from it
+// (see CertIdentity). The certificates of the supervisors must have the
+// organizational unit expected by the agents (see Agent.SupervisorOU).
+type CertSigner struct {
+	id    string
+	chain [][]byte
+	key   crypto.Signer
+}
+
+// NewCertSigner returns a CertSigner that uses the given certificate.
+func NewCertSigner(cert tls.Certificate) (*CertSigner, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+	id := CertIdentity(leaf)
+	if id == "" {
+		return nil, errors.New("certificate without identity")
+	}
+	return &CertSigner{id: id, chain: cert.Certificate, key: key}, nil
+}
+
+// KeyID returns the identity derived from the certificate.
+func (s *CertSigner) KeyID() string {
+	return s.id
+}
+
+// Sign returns the signature of msg. Ed25519 keys sign the message itself,
+// while RSA (PKCS #1 v1.5) and ECDSA keys sign its SHA-256 digest.
+func (s *CertSigner) Sign(msg []byte) ([]byte, error) {
+	if _, ok := s.key.Public().(ed25519.PublicKey); ok {
+		return s.key.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// Certificates returns the DER encoded certificate chain.
+func (s *CertSigner) Certificates() [][]byte {
+	return s.chain
+}
+
+// CertIdentity returns the identity of the owner of a certificate: its
+// subject common name or, if it is empty, its first DNS, URI or email subject
+// alternative name.
+func CertIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// verifyCert checks that the certificate chain is issued by one of the
+// trusted CAs, that sig is a valid signature of msg made with the key of its
+// leaf certificate and that the identity of the certificate is id. If ou is
+// not empty, the subject of the leaf certificate must have that
+// organizational unit.
+func verifyCert(chain [][]byte, roots *x509.CertPool, ou, id string, msg, sig []byte) error {
+	certs := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return ErrUntrustedCert
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, err := leaf.Verify(opts); err != nil {
+		return ErrUntrustedCert
+	}
+	if ou != "" && !hasOU(leaf, ou) {
+		return ErrUntrustedCert
+	}
+	if CertIdentity(leaf) != id {
+		return ErrBadSignature
+	}
+
+	digest := sha256.Sum256(msg)
+	var ok bool
+	switch pub := leaf.PublicKey.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, msg, sig)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// hasOU reports whether the subject of the certificate has the given
+// organizational unit.
+func hasOU(cert *x509.Certificate, ou string) bool {
+	for _, v := range cert.Subject.OrganizationalUnit {
+		if v == ou {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+const testSupervisorOU = "monmq-supervisor"
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a client certificate for the given common name,
+// organizational unit and DNS names. Ed25519 keys are used if ed is true;
+// otherwise, ECDSA keys.
+func (ca testCA) issue(t *testing.T, cn, ou string, dnsNames []string, ed bool) tls.Certificate {
+	var key crypto.Signer
+	var err error
+	if ed {
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ous []string
+	if ou != "" {
+		ous = []string{ou}
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: ous},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestCertSigner(t *testing.T, cert tls.Certificate) *CertSigner {
+	signer, err := NewCertSigner(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestCertSignedCommands(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.TrustedCAs = ca.pool
+	az, err := NewAuthorizer(AccessPolicy{
+		Roles:      map[string]Role{"operator": {Commands: []string{"Pause"}}},
+		Identities: map[string][]string{"ops.example.com": {"operator"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Authorizer = az
+
+	tests := []struct {
+		cert    tls.Certificate
+		wantErr error
+	}{
+		{ca.issue(t, "", testSupervisorOU, []string{"ops.example.com"}, false), nil},
+		{ca.issue(t, "ops.example.com", testSupervisorOU, nil, true), nil},
+		{ca.issue(t, "intruder", testSupervisorOU, nil, false), ErrDenied},
+		{other.issue(t, "ops.example.com", testSupervisorOU, nil, false), ErrUntrustedCert},
+		// Agent certificates cannot sign commands.
+		{ca.issue(t, "ops.example.com", "", nil, false), ErrUntrustedCert},
+	}
+	for i, tt := range tests {
+		s := NewSupervisor("", "", "")
+		s.Signer = newTestCertSigner(t, tt.cert)
+		data, err := s.encodeRequest(Pause, "w1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = 0
+		_, err = a.invoke("id", data)
+		switch {
+		case tt.wantErr == nil && err != nil:
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		case tt.wantErr != nil && (err == nil || !strings.Contains(err.Error(), tt.wantErr.Error())):
+			t.Errorf("test %d: error = %v, want %v", i, err, tt.wantErr)
+		case (tt.wantErr == nil) != (calls == 1):
+			t.Errorf("test %d: PauseFunc called %d times", i, calls)
+		}
+	}
+}
+
+func TestImpersonatedCertIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	s := NewSupervisor("", "", "")
+	s.Signer = newTestCertSigner(t, ca.issue(t, "ops", testSupervisorOU, nil, false))
+	data, err := s.encodeRequest(Pause, "w1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	e.KeyID = "admin"
+	if data, err = json.Marshal(e); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.TrustedCAs = ca.pool
+	if _, err := a.invoke("id", data); err == nil || !strings.Contains(err.Error(), ErrBadSignature.Error()) {
+		t.Errorf("error = %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestAgentIdentityBinding(t *testing.T) {
+	ca := newTestCA(t)
+	s := NewSupervisor("", "", "")
+	s.TrustedCAs = ca.pool
+
+	// signedStatus returns the status of the agent name signed with a
+	// certificate issued to certName, replying to the request id.
+	signedStatus := func(id, name, certName string) []byte {
+		a := NewAgent("", "", name)
+		a.Signer = newTestCertSigner(t, ca.issue(t, certName, "", nil, false))
+		data, err := a.encodeReply(id, []byte(fmt.Sprintf(`%c{"Name":%q}`, GetStatus, name)), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	replayed := signedStatus("id0", "w1", "w1")
+	tests := []struct {
+		id      string
+		data    []byte
+		wantErr string
+	}{
+		{"id0", replayed, ""},
+		{"id1", signedStatus("id1", "w2", "w1"), ErrIdentityMismatch.Error()},
+		{"id2", []byte(fmt.Sprintf(`%c{"Name":"w3"}`, GetStatus)), "malformed response"},
+		{"id0", replayed, ErrReplayed.Error()},
+		{"id3", signedStatus("id0", "w1", "w1"), ErrReplayed.Error()},
+	}
+	for i, tt := range tests {
+		err := s.route(rpcmq.Result{UUID: tt.id, Data: tt.data})
+		if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+			t.Errorf("test %d: error = %v, want %q", i, err, tt.wantErr)
+		}
+	}
+	if st := s.Status(); len(st) != 1 || st[0].Name != "w1" {
+		t.Errorf("Status() = %+v", st)
+	}
+}
+
+func TestSignedReplyReplay(t *testing.T) {
+	key := HMACKey{ID: "w1", Secret: []byte("secret")}
+	s := NewSupervisor("", "", "")
+	s.TrustedKeys = []Verifier{key}
+	status := []byte(fmt.Sprintf(`%c{"Name":"w1"}`, GetStatus))
+
+	a := NewAgent("", "", "w1")
+	a.Signer = key
+	fresh, err := a.encodeReply("id", status, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := signReply("old", status, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxReplyAge = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if err := s.route(rpcmq.Result{UUID: "old", Data: old}); err != ErrExpired {
+		t.Errorf("old reply: error = %v, want %v", err, ErrExpired)
+	}
+
+	s.MaxReplyAge = time.Minute
+	if err := s.route(rpcmq.Result{UUID: "other", Data: fresh}); err != ErrReplayed {
+		t.Errorf("reply to another request: error = %v, want %v", err, ErrReplayed)
+	}
+	// Pushed status are not bound to a request, but cannot be replayed.
+	if err := s.handleResult(rpcmq.Result{UUID: "push", Data: fresh}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.handleResult(rpcmq.Result{UUID: "push", Data: fresh}, true); err != ErrReplayed {
+		t.Errorf("replayed status: error = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestCertSignedCommandsWithoutOU(t *testing.T) {
+	ca := newTestCA(t)
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.TrustedCAs = ca.pool
+	a.SupervisorOU = ""
+
+	s := NewSupervisor("", "", "")
+	s.Signer = newTestCertSigner(t, ca.issue(t, "w2", "", nil, false))
+	data, err := s.encodeRequest(Pause, "w1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without Authorizer, any agent could command the fleet.
+	if _, err := a.invoke("id", data); err == nil || !strings.Contains(err.Error(), ErrUntrustedCert.Error()) {
+		t.Errorf("error = %v, want %v", err, ErrUntrustedCert)
+	}
+}
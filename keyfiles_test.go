@@ -0,0 +1,122 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+func writeKeyFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadedKeysRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacPath := writeKeyFile(t, dir, "hmac", []byte("shared secret\n"))
+	privPath := writeKeyFile(t, dir, "ed.key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+	pubPath := writeKeyFile(t, dir, "ed.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	keyring := writeKeyFile(t, dir, "keyring", []byte(
+		"# old key\n"+
+			"k0 "+strings.Repeat("00", 32)+" 2015-01-01T00:00:00Z\n"+
+			"\n"+
+			"k1 "+strings.Repeat("01", 32)+" 2015-06-01T00:00:00Z\n"))
+
+	tests := []struct {
+		signer, verifier string
+	}{
+		{hmacPath, hmacPath},
+		{privPath, pubPath},
+	}
+	for i, tt := range tests {
+		s := NewSupervisor("", "", "")
+		if s.Signer, err = LoadSigner(tt.signer, "ops"); err != nil {
+			t.Fatal(err)
+		}
+		if s.Keyring, err = LoadKeyring(keyring); err != nil {
+			t.Fatal(err)
+		}
+
+		var calls int
+		a := newTestAgent("w1", &calls)
+		v, err := LoadVerifier(tt.verifier, "ops")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.TrustedKeys = []Verifier{v}
+		if a.Keyring, err = LoadKeyring(keyring); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := s.encodeRequest(Pause, "w1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isSealed(data) {
+			t.Fatalf("test %d: request not encrypted", i)
+		}
+		reply, err := a.invoke("id", data)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		ch := make(chan Reply, 1)
+		s.pending["id"] = ch
+		if err := s.route(rpcmq.Result{UUID: "id", Data: reply}); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-ch; r.Command != Pause || calls != 1 {
+			t.Errorf("test %d: reply = %+v, calls = %d", i, r, calls)
+		}
+	}
+}
+
+func TestLoadKeyringErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monmq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, line := range []string{
+		"k1",
+		"k1 nothex",
+		"k1 0102",
+		"k1 " + strings.Repeat("01", 32) + " yesterday",
+	} {
+		if _, err := LoadKeyring(writeKeyFile(t, dir, "keyring", []byte(line+"\n"))); err == nil {
+			t.Errorf("keyring %q loaded", line)
+		}
+	}
+}
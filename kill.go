@@ -0,0 +1,109 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTaskKilled is the cause of the cancellation of the context of a task
+// killed by a supervisor (see context.Cause). The reason sent by the
+// supervisor, if any, is appended to the error message.
+var ErrTaskKilled = errors.New("task killed")
+
+// Outcomes of the KillTask command.
+const (
+	// KillCancelled means that the task returned after cancelling its
+	// context.
+	KillCancelled = "cancelled"
+
+	// KillRunning means that the task is still running after
+	// KillGracePeriod and the agent has no KillTaskFunc.
+	KillRunning = "running"
+
+	// KillForced means that the task did not return after
+	// KillGracePeriod, so KillTaskFunc was called.
+	KillForced = "forced"
+)
+
+// A KillResult is the data replied by an agent to a KillTask command.
+type KillResult struct {
+	Task    string
+	Outcome string
+	Reason  string `json:",omitempty"`
+
+	// Data is the data returned by KillTaskFunc, if it was called.
+	Data []byte `json:",omitempty"`
+}
+
+// A KillTaskFunction is called to force the termination of a task that did
+// not return after cancelling its context. It receives the id of the task
+// and the kill reason sent by the supervisor, and returns auxiliary data that
+// is reported in KillResult.Data.
+type KillTaskFunction func(id string, reason []byte) ([]byte, error)
+
+// A task is a task registered by an agent.
+type task struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{} // closed when the task is removed
+}
+
+// killTask cancels the context of the task and waits for it to return. The
+// data sent by the supervisor is the reason of the kill.
+func (a *Agent) killTask(id string, data []byte) ([]byte, error) {
+	a.mu.RLock()
+	t, ok := a.tasks[id]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	reason := string(data)
+	cause := ErrTaskKilled
+	if reason != "" {
+		cause = fmt.Errorf("%w: %s", ErrTaskKilled, reason)
+	}
+	t.cancel(cause)
+
+	res := KillResult{Task: id, Reason: reason}
+	if waitTask(t, a.KillGracePeriod) {
+		res.Outcome = KillCancelled
+	} else {
+		res.Outcome = KillRunning
+		if a.KillTaskFunc != nil {
+			b, err := a.KillTaskFunc(id, data)
+			if err != nil {
+				return nil, err
+			}
+			res.Outcome, res.Data = KillForced, b
+		}
+	}
+	logf("task %s: kill %s", id, res.Outcome)
+	return json.Marshal(res)
+}
+
+// waitTask waits up to grace for the task to return and reports whether it
+// did. If grace is lower than or equal to zero, it does not wait.
+func waitTask(t *task, grace time.Duration) bool {
+	if grace <= 0 {
+		select {
+		case <-t.done:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
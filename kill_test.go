@@ -0,0 +1,129 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func killResult(t *testing.T, reply []byte) KillResult {
+	if len(reply) < 1 || Command(reply[0]) != KillTask {
+		t.Fatalf("malformed reply %q", reply)
+	}
+	var res KillResult
+	if err := json.Unmarshal(reply[1:], &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestKillTaskCancelled(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	a.status.State = Running
+	ctx := a.RegisterTask("t1")
+	go func() {
+		<-ctx.Done()
+		a.RemoveTask("t1")
+	}()
+
+	reply, err := a.invoke("id", encodeInvocation(KillTask, "t1", []byte("stuck")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := killResult(t, reply); res.Outcome != KillCancelled || res.Task != "t1" || res.Reason != "stuck" {
+		t.Errorf("KillResult = %+v", res)
+	}
+	cause := context.Cause(ctx)
+	if !errors.Is(cause, ErrTaskKilled) || !strings.Contains(cause.Error(), "stuck") {
+		t.Errorf("cause = %v", cause)
+	}
+}
+
+func TestKillTaskEscalation(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	a.status.State = Running
+	a.KillGracePeriod = 10 * time.Millisecond
+	a.RegisterTask("t1")
+
+	reply, err := a.invoke("id", encodeInvocation(KillTask, "t1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := killResult(t, reply); res.Outcome != KillRunning {
+		t.Errorf("KillResult = %+v", res)
+	}
+
+	var killed, reason string
+	a.KillTaskFunc = func(id string, data []byte) ([]byte, error) {
+		killed, reason = id, string(data)
+		a.RemoveTask(id)
+		return []byte("killed"), nil
+	}
+	reply, err = a.invoke("id", encodeInvocation(KillTask, "t1", []byte("stuck")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := killResult(t, reply); res.Outcome != KillForced || string(res.Data) != "killed" {
+		t.Errorf("KillResult = %+v", res)
+	}
+	if killed != "t1" || reason != "stuck" {
+		t.Errorf("KillTaskFunc called with id %q and reason %q", killed, reason)
+	}
+	if a.ownsTask("t1") {
+		t.Error("task not removed")
+	}
+}
+
+func TestKillTaskNoGracePeriod(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	a.status.State = Running
+	a.KillGracePeriod = 0
+	// The tasks ignore their contexts.
+	a.RegisterTask("t1")
+	a.RegisterTask("t2")
+
+	var killed []string
+	a.KillTaskFunc = func(id string, data []byte) ([]byte, error) {
+		killed = append(killed, id)
+		return nil, nil
+	}
+	start := time.Now()
+	reply, err := a.invoke("id", encodeInvocation(KillTask, "t2", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := killResult(t, reply); res.Outcome != KillForced || res.Task != "t2" {
+		t.Errorf("KillResult = %+v", res)
+	}
+	if len(killed) != 1 || killed[0] != "t2" {
+		t.Errorf("KillTaskFunc called for %v, want [t2]", killed)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("KillTask took %v without grace period", d)
+	}
+}
+
+func TestTaskContext(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	ctx := a.RegisterTask("t1")
+	if a.RegisterTask("t1") != ctx || a.TaskContext("t1") != ctx {
+		t.Error("different contexts for the same task")
+	}
+	if len(a.status.Tasks) != 1 {
+		t.Errorf("Tasks = %v", a.status.Tasks)
+	}
+	a.RemoveTask("t1")
+	if ctx.Err() == nil {
+		t.Error("context not cancelled after removing the task")
+	}
+	if context.Cause(a.TaskContext("t1")) != ErrTaskNotFound {
+		t.Error("context of unknown task not cancelled")
+	}
+}
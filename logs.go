@@ -0,0 +1,294 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoLogBuffer is returned by the agents that receive a GetLogs command
+// but do not keep their logs (see Agent.Logs).
+var ErrNoLogBuffer = errors.New("log buffer not configured")
+
+// LogLevel is the severity of a log line.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+var logLevelNames = []string{
+	LogDebug:   "debug",
+	LogInfo:    "info",
+	LogWarning: "warning",
+	LogError:   "error",
+}
+
+func (l LogLevel) String() string {
+	if l >= 0 && int(l) < len(logLevelNames) {
+		return logLevelNames[l]
+	}
+	return fmt.Sprintf("LogLevel(%d)", l)
+}
+
+// ParseLogLevel returns the log level with the given name. Besides the names
+// returned by LogLevel.String, it accepts "warn" and "err". The comparison is
+// case-insensitive.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	case "warn", "warning":
+		return LogWarning, nil
+	case "err", "error":
+		return LogError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// levelWords is the number of words at the beginning of a line that are
+// checked to find its level, so the prefix added by a log.Logger (date, time
+// and file) is skipped.
+const levelWords = 4
+
+// lineLevel returns the level of a log line, which is the first word among
+// the first levelWords of the line that is a level name, optionally enclosed
+// in brackets or followed by a colon (e.g. "[WARN]" or "error:"). Lines
+// without level are considered LogInfo.
+func lineLevel(text string) LogLevel {
+	words := strings.Fields(text)
+	if len(words) > levelWords {
+		words = words[:levelWords]
+	}
+	for _, w := range words {
+		if l, err := ParseLogLevel(strings.Trim(w, "[]:")); err == nil {
+			return l
+		}
+	}
+	return LogInfo
+}
+
+// maxLineLen is the maximum length of the lines kept by a LogBuffer. Longer
+// lines are split, so they fit in the replies to GetLogs and incomplete
+// lines cannot grow without limit.
+const maxLineLen = 16 << 10
+
+// LogLine is a line kept by a LogBuffer.
+type LogLine struct {
+	// Seq is the sequence number of the line. It increases by one for
+	// every line written to the buffer.
+	Seq   uint64
+	Time  time.Time
+	Level LogLevel
+	Text  string
+}
+
+// A LogBuffer keeps the last lines written to it, so they can be retrieved
+// by the supervisors with the GetLogs command. It is an io.Writer, thus it
+// can be used as the output of Log or of any other log.Logger, usually
+// along with the original output:
+//
+//	buf := monmq.NewLogBuffer(1000)
+//	monmq.Log = log.New(io.MultiWriter(os.Stderr, buf), "", log.LstdFlags)
+//	a.Logs = buf
+type LogBuffer struct {
+	mu      sync.Mutex
+	lines   []LogLine
+	next    int
+	seq     uint64
+	partial []byte
+}
+
+// NewLogBuffer returns a reference to a LogBuffer that keeps the last size
+// lines. If size is not positive, no lines are kept.
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &LogBuffer{lines: make([]LogLine, 0, size)}
+}
+
+// Write adds the lines in p to the buffer. Incomplete lines are kept until
+// the following writes complete them. Lines longer than 16KiB are split.
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data := append(b.partial, p...)
+	now := time.Now()
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i >= 0 && i <= maxLineLen {
+			b.add(now, string(data[:i]))
+			data = data[i+1:]
+			continue
+		}
+		if len(data) < maxLineLen {
+			break
+		}
+		b.add(now, string(data[:maxLineLen]))
+		data = data[maxLineLen:]
+	}
+	b.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// add appends a line to the buffer, replacing the oldest one if it is full.
+// The caller must hold b.mu.
+func (b *LogBuffer) add(t time.Time, text string) {
+	if cap(b.lines) == 0 {
+		return
+	}
+	b.seq++
+	l := LogLine{Seq: b.seq, Time: t, Level: lineLevel(text), Text: text}
+	if len(b.lines) < cap(b.lines) {
+		b.lines = append(b.lines, l)
+		return
+	}
+	b.lines[b.next] = l
+	b.next = (b.next + 1) % len(b.lines)
+}
+
+// LogQuery selects the lines returned by a GetLogs command. The zero value
+// selects all the lines kept by the agent.
+type LogQuery struct {
+	// Lines is the maximum number of lines. If it is greater than zero,
+	// only the last Lines lines are selected.
+	Lines int `json:",omitempty"`
+
+	// Since selects the lines written at or after the given time.
+	Since time.Time
+
+	// Level is the minimum level of the lines.
+	Level LogLevel `json:",omitempty"`
+
+	// After and Until select the lines whose sequence number is greater
+	// than After and not greater than Until. They are used to fetch the
+	// following chunks of a reply (see LogChunk).
+	After uint64 `json:",omitempty"`
+	Until uint64 `json:",omitempty"`
+}
+
+// LogChunk is the reply to a GetLogs command. Replies bigger than
+// Agent.LogChunkSize are split in several chunks. If More is true, the
+// following chunk can be requested with the same query, setting After to
+// the sequence number of the last line and Until to the one of the chunk.
+type LogChunk struct {
+	Lines []LogLine
+	Until uint64
+	More  bool
+}
+
+// Lines returns the lines selected by q, oldest first.
+func (b *LogBuffer) Lines(q LogQuery) []LogLine {
+	lines, _ := b.selectLines(q)
+	return lines
+}
+
+// selectLines returns the lines selected by q and the sequence number of
+// the last line in the buffer.
+func (b *LogBuffer) selectLines(q LogQuery) ([]LogLine, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var lines []LogLine
+	for i := range b.lines {
+		l := b.lines[(b.next+i)%len(b.lines)]
+		switch {
+		case l.Seq <= q.After:
+		case q.Until != 0 && l.Seq > q.Until:
+		case l.Time.Before(q.Since):
+		case l.Level < q.Level:
+		default:
+			lines = append(lines, l)
+		}
+	}
+	if q.Lines > 0 && len(lines) > q.Lines {
+		lines = lines[len(lines)-q.Lines:]
+	}
+	return lines, b.seq
+}
+
+// chunk returns the first chunk of the lines selected by q whose JSON
+// encoding does not exceed size bytes. At least one line is returned if any
+// is selected.
+func (b *LogBuffer) chunk(q LogQuery, size int) ([]byte, error) {
+	lines, seq := b.selectLines(q)
+	c := LogChunk{Until: q.Until}
+	if c.Until == 0 {
+		c.Until = seq
+	}
+
+	n := 0
+	for i, l := range lines {
+		lb, err := json.Marshal(l)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && n+len(lb) > size {
+			c.More = true
+			break
+		}
+		n += len(lb) + 1
+		c.Lines = append(c.Lines, l)
+	}
+	return json.Marshal(c)
+}
+
+// getLogs is the function executed by the agent on GetLogs commands.
+func (a *Agent) getLogs(data []byte) ([]byte, error) {
+	if a.Logs == nil {
+		return nil, ErrNoLogBuffer
+	}
+	var q LogQuery
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &q); err != nil {
+			return nil, err
+		}
+	}
+	return a.Logs.chunk(q, a.LogChunkSize)
+}
+
+// Logs returns the log lines selected by q from the given agent, oldest
+// first. The lines are fetched in as many GetLogs commands as chunks are
+// needed, waiting up to timeout for every reply.
+func (s *Supervisor) Logs(agent string, q LogQuery, timeout time.Duration) ([]LogLine, error) {
+	var lines []LogLine
+	for {
+		args, err := json.Marshal(q)
+		if err != nil {
+			return nil, err
+		}
+		r, err := s.InvokeWait(GetLogs, agent, args, timeout)
+		if err != nil {
+			return nil, err
+		}
+		var c LogChunk
+		if err := json.Unmarshal(r.Data, &c); err != nil {
+			return nil, err
+		}
+		lines = append(lines, c.Lines...)
+		if !c.More || len(c.Lines) == 0 {
+			return lines, nil
+		}
+		// The following chunks are selected from the same lines,
+		// excluding the ones already received.
+		q.After, q.Until = c.Lines[len(c.Lines)-1].Seq, c.Until
+		if q.Lines > 0 {
+			q.Lines -= len(c.Lines)
+		}
+	}
+}
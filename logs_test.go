@@ -0,0 +1,143 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lineTexts(lines []LogLine) []string {
+	var texts []string
+	for _, l := range lines {
+		texts = append(texts, l.Text)
+	}
+	return texts
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := NewLogBuffer(3)
+	l := log.New(b, "", log.LstdFlags)
+	l.Print("starting")
+	l.Print("[WARN] disk almost full")
+	fmt.Fprint(b, "error: partial")
+	fmt.Fprint(b, " line\ndebug: connected\n")
+
+	lines := b.Lines(LogQuery{})
+	if got := fmt.Sprint(lineTexts(lines)); len(lines) != 3 || lines[0].Seq != 2 || lines[2].Seq != 4 ||
+		lines[1].Text != "error: partial line" || lines[2].Text != "debug: connected" {
+		t.Fatalf("Lines = %s", got)
+	}
+	levels := []LogLevel{LogWarning, LogError, LogDebug}
+	for i, l := range lines {
+		if l.Level != levels[i] {
+			t.Errorf("line %q level = %v, want %v", l.Text, l.Level, levels[i])
+		}
+	}
+
+	tests := []struct {
+		q    LogQuery
+		want int
+	}{
+		{LogQuery{Lines: 1}, 1},
+		{LogQuery{Level: LogWarning}, 2},
+		{LogQuery{Since: time.Now().Add(time.Minute)}, 0},
+		{LogQuery{After: 2, Until: 3}, 1},
+	}
+	for _, tt := range tests {
+		if got := b.Lines(tt.q); len(got) != tt.want {
+			t.Errorf("Lines(%+v) = %v, want %d lines", tt.q, lineTexts(got), tt.want)
+		}
+	}
+}
+
+func TestLogBufferLongLines(t *testing.T) {
+	b := NewLogBuffer(10)
+	chunk := strings.Repeat("x", 1000)
+	for i := 0; i < 3*maxLineLen/len(chunk)+1; i++ {
+		fmt.Fprint(b, chunk)
+		if len(b.partial) >= maxLineLen {
+			t.Fatalf("incomplete line of %d bytes", len(b.partial))
+		}
+	}
+	fmt.Fprint(b, "\nshort\n")
+
+	lines := b.Lines(LogQuery{})
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want 5", len(lines))
+	}
+	total := 0
+	for _, l := range lines[:4] {
+		if len(l.Text) > maxLineLen {
+			t.Errorf("line of %d bytes", len(l.Text))
+		}
+		total += len(l.Text)
+	}
+	if want := (3*maxLineLen/len(chunk) + 1) * len(chunk); total != want {
+		t.Errorf("%d bytes kept, want %d", total, want)
+	}
+	if lines[4].Text != "short" {
+		t.Errorf("last line = %q, want %q", lines[4].Text, "short")
+	}
+}
+
+func TestLogBufferNegativeSize(t *testing.T) {
+	b := NewLogBuffer(-1)
+	if _, err := b.Write([]byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetLogsChunks(t *testing.T) {
+	var calls int
+	a := newTestAgent("w1", &calls)
+	if _, err := a.invoke("id", encodeInvocation(GetLogs, "w1", nil)); err == nil {
+		t.Error("GetLogs succeeded without log buffer")
+	}
+
+	a.Logs = NewLogBuffer(100)
+	a.LogChunkSize = 200
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(a.Logs, "line %d\n", i)
+	}
+
+	// Fetch the last 8 lines like Supervisor.Logs does.
+	q := LogQuery{Lines: 8}
+	var lines []LogLine
+	chunks := 0
+	for {
+		args, err := json.Marshal(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := a.invoke("id", encodeInvocation(GetLogs, "w1", args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c LogChunk
+		if err := json.Unmarshal(reply[1:], &c); err != nil {
+			t.Fatal(err)
+		}
+		chunks++
+		lines = append(lines, c.Lines...)
+		if !c.More {
+			break
+		}
+		// Lines written meanwhile are not included.
+		fmt.Fprintln(a.Logs, "new line")
+		q.After, q.Until = c.Lines[len(c.Lines)-1].Seq, c.Until
+		q.Lines -= len(c.Lines)
+	}
+	if chunks < 2 {
+		t.Errorf("reply not chunked")
+	}
+	if len(lines) != 8 || lines[0].Text != "line 2" || lines[7].Text != "line 9" {
+		t.Errorf("lines = %v", lineTexts(lines))
+	}
+}
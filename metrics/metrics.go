@@ -0,0 +1,157 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package metrics exports the status of the agents seen by a monmq supervisor
+as Prometheus metrics, using the text exposition format.
+
+Every metric is labeled with the name of the agent ("agent") and with its
+labels, whose keys are prefixed with "label_". The lifecycle state of the
+agents is exported as the monmq_agent_state gauge, which has a series for
+every state ("state") whose value is 1 for the current state of the agent
+and 0 for the others.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+// Source is the interface that must be implemented by the source of the
+// metrics. It is satisfied by *monmq.Supervisor.
+type Source interface {
+	Status() []monmq.Status
+}
+
+type metric struct {
+	name  string
+	help  string
+	value func(st monmq.Status) float64
+}
+
+var metrics = []metric{
+	{"monmq_agent_running", "Whether the agent is running (1) or not (0).",
+		func(st monmq.Status) float64 { return boolValue(st.State == monmq.Running) }},
+	{"monmq_agent_state_seconds", "Seconds since the agent changed to its current lifecycle state.",
+		func(st monmq.Status) float64 { return time.Since(st.StateSince).Seconds() }},
+	{"monmq_agent_tasks", "Number of tasks handled by the agent.",
+		func(st monmq.Status) float64 { return float64(len(st.Tasks)) }},
+	{"monmq_agent_last_beat_seconds", "Seconds since the last status update of the agent.",
+		func(st monmq.Status) float64 { return time.Since(st.LastBeat).Seconds() }},
+	{"monmq_host_cpu_ratio", "CPU usage of the agent's host.",
+		func(st monmq.Status) float64 { return st.Info.CPU }},
+	{"monmq_host_ram_total_bytes", "Total RAM of the agent's host.",
+		func(st monmq.Status) float64 { return float64(st.Info.TotalRam) }},
+	{"monmq_host_ram_free_bytes", "Free RAM of the agent's host.",
+		func(st monmq.Status) float64 { return float64(st.Info.FreeRam) }},
+	{"monmq_host_swap_total_bytes", "Total swap of the agent's host.",
+		func(st monmq.Status) float64 { return float64(st.Info.TotalSwap) }},
+	{"monmq_host_swap_free_bytes", "Free swap of the agent's host.",
+		func(st monmq.Status) float64 { return float64(st.Info.FreeSwap) }},
+	{"monmq_host_uptime_seconds", "Uptime of the agent's host.",
+		func(st monmq.Status) float64 { return st.Info.Uptime.Seconds() }},
+	{"monmq_process_rss_bytes", "Resident memory of the agent's process.",
+		func(st monmq.Status) float64 { return float64(st.Info.Proc.TotalRam) }},
+	{"monmq_process_cpu_ratio", "CPU usage of the agent's process.",
+		func(st monmq.Status) float64 { return st.Info.Proc.CPU }},
+}
+
+// states are the lifecycle states exported by the monmq_agent_state metric.
+var states = []monmq.State{
+	monmq.Starting,
+	monmq.Running,
+	monmq.Pausing,
+	monmq.Paused,
+	monmq.Draining,
+	monmq.Stopping,
+	monmq.Stopped,
+}
+
+// Write writes the metrics of the given agents to w.
+func Write(w io.Writer, status []monmq.Status) error {
+	status = append([]monmq.Status(nil), status...)
+	sort.Sort(byName(status))
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(bw, "# TYPE %s gauge\n", m.name)
+		for _, st := range status {
+			fmt.Fprintf(bw, "%s%s %g\n", m.name, labels(st), m.value(st))
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP monmq_agent_state Whether the agent is in the given lifecycle state (1) or not (0).\n")
+	fmt.Fprintf(bw, "# TYPE monmq_agent_state gauge\n")
+	for _, st := range status {
+		for _, state := range states {
+			fmt.Fprintf(bw, "monmq_agent_state%s %g\n",
+				labels(st, `state="`+escape(string(state))+`"`), boolValue(st.State == state))
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler returns a http.Handler that serves the metrics of the agents
+// reported by s.
+func Handler(s Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w, s.Status())
+	})
+}
+
+// labels returns the label set of the agent, including the given extra
+// label pairs.
+func labels(st monmq.Status, extra ...string) string {
+	keys := make([]string, 0, len(st.Labels))
+	for k := range st.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := append([]string{`agent="` + escape(st.Name) + `"`}, extra...)
+	for _, k := range keys {
+		pairs = append(pairs, "label_"+sanitize(k)+`="`+escape(st.Labels[k])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sanitize replaces the characters that are not allowed in label names.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape escapes the label value as required by the exposition format.
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type byName []monmq.Status
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
@@ -0,0 +1,67 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+var _ Source = (*monmq.Supervisor)(nil)
+
+func TestWrite(t *testing.T) {
+	status := []monmq.Status{
+		{
+			Name:  "w2",
+			State: monmq.Paused,
+			Info:  monmq.SystemInfo{CPU: 0.25},
+		},
+		{
+			Name:     "w1",
+			Labels:   map[string]string{"data-center": `mad"1`},
+			State:    monmq.Running,
+			Tasks:    []string{"t1", "t2"},
+			Info:     monmq.SystemInfo{TotalRam: 1024, Proc: monmq.ProcInfo{TotalRam: 512}},
+			LastBeat: time.Now(),
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, status); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	want := []string{
+		"# TYPE monmq_agent_running gauge\n",
+		`monmq_agent_running{agent="w1",label_data_center="mad\"1"} 1` + "\n",
+		`monmq_agent_running{agent="w2"} 0` + "\n",
+		`monmq_agent_tasks{agent="w1",label_data_center="mad\"1"} 2` + "\n",
+		`monmq_host_cpu_ratio{agent="w2"} 0.25` + "\n",
+		`monmq_host_ram_total_bytes{agent="w1",label_data_center="mad\"1"} 1024` + "\n",
+		`monmq_process_rss_bytes{agent="w1",label_data_center="mad\"1"} 512` + "\n",
+		"# TYPE monmq_agent_state gauge\n",
+		`monmq_agent_state{agent="w1",state="running",label_data_center="mad\"1"} 1` + "\n",
+		`monmq_agent_state{agent="w1",state="paused",label_data_center="mad\"1"} 0` + "\n",
+		`monmq_agent_state{agent="w2",state="running"} 0` + "\n",
+		`monmq_agent_state{agent="w2",state="paused"} 1` + "\n",
+		`monmq_agent_state{agent="w2",state="stopped"} 0` + "\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("missing %q in output:\n%s", w, out)
+		}
+	}
+	if strings.Index(out, `{agent="w1"`) > strings.Index(out, `{agent="w2"`) {
+		t.Error("agents are not sorted by name")
+	}
+	if n := strings.Count(out, "monmq_agent_state{"); n != 2*len(states) {
+		t.Errorf("%d monmq_agent_state series, want one per agent and state", n)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package push periodically sends the status of the agents seen by a monmq
+supervisor to a StatsD or Graphite server.
+
+The following metrics are sent for every agent, under the prefix computed
+from the Prefix template:
+
+	running          1 if the agent is running, 0 otherwise
+	tasks            number of tasks
+	cpu              CPU usage of the host
+	ram.total        total RAM of the host
+	ram.free         free RAM of the host
+	swap.total       total swap of the host
+	swap.free        free swap of the host
+	uptime           uptime of the host in seconds
+	proc.ram         resident memory of the agent's process
+	proc.cpu         CPU usage of the agent's process
+	metrics.<name>   custom metrics set by the agent
+
+The dots in the names and labels of the agents are replaced by underscores
+before executing the Prefix template, so they do not add levels to the
+metric paths. StatsD metrics are sent as gauges.
+*/
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+// Source is the interface that must be implemented by the source of the
+// metrics. It is satisfied by *monmq.Supervisor.
+type Source interface {
+	Status() []monmq.Status
+}
+
+// Format is the line protocol used to send the metrics.
+type Format int
+
+const (
+	StatsD Format = iota
+	Graphite
+)
+
+// defaultInterval is the time between two pushes used if Pusher.Interval is
+// not set.
+const defaultInterval = 10 * time.Second
+
+// A Pusher sends the metrics of the agents to a StatsD or Graphite server.
+type Pusher struct {
+	src  Source
+	done chan bool
+	stop sync.Once
+
+	// Network is the network of the server ("udp" or "tcp"). Default:
+	// udp.
+	Network string
+
+	// Addr is the address of the server.
+	Addr string
+
+	// Format is the line protocol. Default: StatsD.
+	Format Format
+
+	// Prefix is a text/template executed with the monmq.Status of every
+	// agent to compute the prefix of its metrics. Default:
+	// "monmq.{{.Name}}".
+	Prefix string
+
+	// Interval is the time between two pushes. Default: 10s.
+	Interval time.Duration
+}
+
+// NewPusher returns a reference to a Pusher that sends the metrics of the
+// agents reported by src to the server listening on addr.
+func NewPusher(src Source, addr string) *Pusher {
+	p := &Pusher{
+		src:      src,
+		done:     make(chan bool),
+		Network:  "udp",
+		Addr:     addr,
+		Format:   StatsD,
+		Prefix:   "monmq.{{.Name}}",
+		Interval: defaultInterval,
+	}
+	return p
+}
+
+// Start parses the Prefix template and starts pushing the metrics
+// periodically. Errors sending the metrics are logged using monmq.Log. The
+// fields of the Pusher must not be modified after calling Start.
+func (p *Pusher) Start() error {
+	prefix, err := p.parsePrefix()
+	if err != nil {
+		return err
+	}
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				if err := p.push(prefix); err != nil && monmq.Log != nil {
+					monmq.Log.Printf("push: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops pushing the metrics. It can be called even if Start was not,
+// and more than once.
+func (p *Pusher) Stop() {
+	p.stop.Do(func() { close(p.done) })
+}
+
+// Push sends the current metrics once.
+func (p *Pusher) Push() error {
+	prefix, err := p.parsePrefix()
+	if err != nil {
+		return err
+	}
+	return p.push(prefix)
+}
+
+func (p *Pusher) parsePrefix() (*template.Template, error) {
+	return template.New("prefix").Option("missingkey=zero").Parse(p.Prefix)
+}
+
+func (p *Pusher) push(prefixTmpl *template.Template) error {
+	conn, err := net.Dial(p.Network, p.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	now := time.Now()
+	for _, st := range p.src.Status() {
+		var prefix bytes.Buffer
+		if err := prefixTmpl.Execute(&prefix, pathStatus(st)); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		for _, m := range metrics(st) {
+			name := sanitize(prefix.String() + "." + m.name)
+			switch p.Format {
+			case Graphite:
+				fmt.Fprintf(&buf, "%s %g %d\n", name, m.value, now.Unix())
+			default:
+				fmt.Fprintf(&buf, "%s:%g|g\n", name, m.value)
+			}
+		}
+		// Every agent is sent in its own write, so every UDP
+		// datagram contains whole lines.
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type metric struct {
+	name  string
+	value float64
+}
+
+func metrics(st monmq.Status) []metric {
+	running := 0.0
+	if st.State == monmq.Running {
+		running = 1
+	}
+	ms := []metric{
+		{"running", running},
+		{"tasks", float64(len(st.Tasks))},
+		{"cpu", st.Info.CPU},
+		{"ram.total", float64(st.Info.TotalRam)},
+		{"ram.free", float64(st.Info.FreeRam)},
+		{"swap.total", float64(st.Info.TotalSwap)},
+		{"swap.free", float64(st.Info.FreeSwap)},
+		{"uptime", st.Info.Uptime.Seconds()},
+		{"proc.ram", float64(st.Info.Proc.TotalRam)},
+		{"proc.cpu", st.Info.Proc.CPU},
+	}
+	names := make([]string, 0, len(st.Metrics))
+	for name := range st.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ms = append(ms, metric{"metrics." + name, st.Metrics[name]})
+	}
+	return ms
+}
+
+// pathStatus returns a copy of st whose name and labels do not contain
+// dots, which separate the levels of the metric paths.
+func pathStatus(st monmq.Status) monmq.Status {
+	st.Name = strings.Replace(st.Name, ".", "_", -1)
+	labels := make(map[string]string, len(st.Labels))
+	for k, v := range st.Labels {
+		labels[k] = strings.Replace(v, ".", "_", -1)
+	}
+	st.Labels = labels
+	return st
+}
+
+// sanitize replaces the characters that have a special meaning in the line
+// protocols.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', ':', '|', '@', '/':
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package push
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/monmq"
+)
+
+var _ Source = (*monmq.Supervisor)(nil)
+
+type fakeSource []monmq.Status
+
+func (s fakeSource) Status() []monmq.Status { return s }
+
+var testStatus = fakeSource{{
+	Name:    "worker 1",
+	Labels:  map[string]string{"dc": "mad"},
+	State:   monmq.Running,
+	Tasks:   []string{"t1"},
+	Info:    monmq.SystemInfo{CPU: 0.5, TotalRam: 1024},
+	Metrics: map[string]float64{"queue.length": 7},
+}}
+
+func listen(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func read(t *testing.T, conn net.PacketConn) string {
+	buf := make([]byte, 65536)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestStatsD(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	p := NewPusher(testStatus, conn.LocalAddr().String())
+	p.Prefix = "fleet.{{.Labels.dc}}.{{.Name}}"
+	if err := p.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := read(t, conn)
+	for _, want := range []string{
+		"fleet.mad.worker_1.running:1|g\n",
+		"fleet.mad.worker_1.tasks:1|g\n",
+		"fleet.mad.worker_1.cpu:0.5|g\n",
+		"fleet.mad.worker_1.ram.total:1024|g\n",
+		"fleet.mad.worker_1.metrics.queue.length:7|g\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	p := NewPusher(testStatus, conn.LocalAddr().String())
+	p.Format = Graphite
+	if err := p.Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(read(t, conn)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "monmq.worker_1.") {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+}
+
+func TestDottedNames(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	src := fakeSource{{
+		Name:   "web.1",
+		Labels: map[string]string{"dc": "eu.mad"},
+		State:  monmq.Running,
+	}}
+	p := NewPusher(src, conn.LocalAddr().String())
+	p.Prefix = "fleet.{{.Labels.dc}}.{{.Name}}"
+	if err := p.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(t, conn), "fleet.eu_mad.web_1.running:1|g\n"; !strings.Contains(got, want) {
+		t.Errorf("missing %q in %q", want, got)
+	}
+	if src[0].Name != "web.1" || src[0].Labels["dc"] != "eu.mad" {
+		t.Errorf("status modified: %+v", src[0])
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	p := NewPusher(testStatus, conn.LocalAddr().String())
+	// Stop must not block if the pusher was not started.
+	p.Stop()
+
+	p = NewPusher(testStatus, conn.LocalAddr().String())
+	p.Interval = time.Millisecond
+	done := make(chan error)
+	go func() {
+		done <- p.Push()
+	}()
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	read(t, conn)
+	read(t, conn)
+	p.Stop()
+	p.Stop()
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"sync"
+	"time"
+)
+
+// A Policy describes an automatic remediation. Every time it is evaluated,
+// Command is invoked on the targets returned by Match.
+type Policy struct {
+	// Name identifies the policy in the logs.
+	Name string
+
+	// Match returns the targets (agent names or task ids) that must be
+	// remediated given the status of an agent.
+	Match func(st Status) []string
+
+	// Command is invoked on every target returned by Match.
+	Command Command
+
+	// ClearCommand is invoked on the targets previously remediated by the
+	// policy once Match stops returning them. GetStatus, the zero value,
+	// disables it.
+	ClearCommand Command
+
+	// Cooldown is the minimum amount of time between two invocations of
+	// Command on the same target.
+	Cooldown time.Duration
+
+	// MaxActions limits the number of invocations of Command performed by
+	// the policy within Window. Zero means no limit.
+	MaxActions int
+
+	// Window is the period of time considered by MaxActions. Zero means
+	// that MaxActions limits the invocations since the remediator was
+	// created.
+	Window time.Duration
+}
+
+// MatchAgent returns a Match function that selects the agent when cond
+// holds.
+func MatchAgent(cond func(st Status) bool) func(st Status) []string {
+	return func(st Status) []string {
+		if cond(st) {
+			return []string{st.Name}
+		}
+		return nil
+	}
+}
+
+// SwapExhausted returns a Match function that selects the agents whose free
+// swap is below the given ratio (e.g. 0.05 for 5%). Agents without swap are
+// never selected.
+func SwapExhausted(ratio float64) func(st Status) []string {
+	return MatchAgent(func(st Status) bool {
+		if st.Info.TotalSwap == 0 {
+			return false
+		}
+		return float64(st.Info.FreeSwap)/float64(st.Info.TotalSwap) < ratio
+	})
+}
+
+// HealthIs returns a Match function that selects the agents whose health is
+// any of the given ones. Agents without health checks are never selected.
+func HealthIs(health ...Health) func(st Status) []string {
+	return MatchAgent(func(st Status) bool {
+		for _, h := range health {
+			if st.Health == h {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TasksOlderThan returns a Match function that selects the tasks that have
+// been running for longer than d.
+func TasksOlderThan(d time.Duration) func(st Status) []string {
+	return func(st Status) []string {
+		var ids []string
+		for _, id := range st.Tasks {
+			if start, ok := st.TaskStart[id]; ok && time.Since(start) > d {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+}
+
+// defaultRemediationInterval is the time between evaluations used when
+// neither Remediator.Interval nor the Beat of the supervisor are set.
+const defaultRemediationInterval = 500 * time.Millisecond
+
+type remediationKey struct {
+	policy string
+	target string
+}
+
+// A Remediator periodically evaluates a set of policies against the status
+// reported by a supervisor and invokes the corresponding commands.
+type Remediator struct {
+	s      *Supervisor
+	invoke func(cmd Command, target string) error
+	done   chan bool
+	stop   sync.Once
+
+	mu       sync.Mutex
+	disabled bool
+	last     map[remediationKey]time.Time
+	active   map[remediationKey]bool
+	actions  map[string][]time.Time
+
+	// Policies is the list of policies evaluated by the remediator.
+	Policies []Policy
+
+	// Interval is the time between evaluations. Default: the Beat of the
+	// supervisor or, if it does not poll the agents, 500ms.
+	Interval time.Duration
+
+	// DryRun makes the remediator only log the commands it would have
+	// invoked.
+	DryRun bool
+}
+
+// NewRemediator returns a reference to a Remediator that acts on the agents
+// seen by the supervisor s.
+func NewRemediator(s *Supervisor) *Remediator {
+	r := &Remediator{
+		s:        s,
+		invoke:   s.Invoke,
+		done:     make(chan bool),
+		last:     make(map[remediationKey]time.Time),
+		active:   make(map[remediationKey]bool),
+		actions:  make(map[string][]time.Time),
+		Interval: s.Beat,
+	}
+	if r.Interval <= 0 {
+		r.Interval = defaultRemediationInterval
+	}
+	return r
+}
+
+// Start starts evaluating the policies periodically. Intervals lower than
+// or equal to zero are replaced by the default one.
+func (r *Remediator) Start() {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultRemediationInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				r.evaluate(r.s.Status(), time.Now())
+			}
+		}
+	}()
+}
+
+// Stop stops the evaluation of the policies. It can be called even if Start
+// was not, and more than once.
+func (r *Remediator) Stop() {
+	r.stop.Do(func() { close(r.done) })
+}
+
+// Disable acts as a kill-switch. While the remediator is disabled, no command
+// is invoked, although the policies are still evaluated and logged.
+func (r *Remediator) Disable() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.disabled = true
+}
+
+// Enable reverts the effect of Disable.
+func (r *Remediator) Enable() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.disabled = false
+}
+
+// Enabled reports whether the remediator is allowed to invoke commands.
+func (r *Remediator) Enabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return !r.disabled
+}
+
+func (r *Remediator) evaluate(status []Status, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.Policies {
+		matched := map[string]bool{}
+		for _, st := range status {
+			for _, target := range p.Match(st) {
+				matched[target] = true
+			}
+		}
+
+		for target := range matched {
+			key := remediationKey{p.Name, target}
+			if now.Sub(r.last[key]) < p.Cooldown {
+				continue
+			}
+			if !r.allow(p, now) {
+				logf("remediation %s: rate limit reached", p.Name)
+				break
+			}
+			if r.run(p.Name, p.Command, target) {
+				r.last[key] = now
+				r.actions[p.Name] = append(r.actions[p.Name], now)
+				r.active[key] = true
+			}
+		}
+
+		for key := range r.active {
+			if key.policy != p.Name || matched[key.target] {
+				continue
+			}
+			if p.ClearCommand != GetStatus && !r.run(p.Name, p.ClearCommand, key.target) {
+				continue
+			}
+			delete(r.active, key)
+		}
+	}
+}
+
+// allow reports whether the policy p is allowed to perform a new action,
+// discarding the actions that are out of its window.
+func (r *Remediator) allow(p Policy, now time.Time) bool {
+	if p.MaxActions <= 0 {
+		return true
+	}
+	var recent []time.Time
+	for _, t := range r.actions[p.Name] {
+		if p.Window == 0 || now.Sub(t) < p.Window {
+			recent = append(recent, t)
+		}
+	}
+	r.actions[p.Name] = recent
+	return len(recent) < p.MaxActions
+}
+
+// run invokes cmd on target unless the remediator is in dry-run mode or
+// disabled. It returns true if the action must be considered done.
+func (r *Remediator) run(policy string, cmd Command, target string) bool {
+	switch {
+	case r.DryRun:
+		logf("remediation %s: would invoke %v on %s (dry-run)", policy, cmd, target)
+		return true
+	case r.disabled:
+		logf("remediation %s: would invoke %v on %s (disabled)", policy, cmd, target)
+		return false
+	}
+	logf("remediation %s: invoking %v on %s", policy, cmd, target)
+	if err := r.invoke(cmd, target); err != nil {
+		logf("remediation %s: %v", policy, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"testing"
+	"time"
+)
+
+type invocation struct {
+	cmd    Command
+	target string
+}
+
+func newTestRemediator(policies ...Policy) (*Remediator, *[]invocation) {
+	var invoked []invocation
+	r := NewRemediator(NewSupervisor("", "", ""))
+	r.invoke = func(cmd Command, target string) error {
+		invoked = append(invoked, invocation{cmd, target})
+		return nil
+	}
+	r.Policies = policies
+	return r, &invoked
+}
+
+func swapStatus(name string, free uint64) Status {
+	return Status{Name: name, Info: SystemInfo{TotalSwap: 100, FreeSwap: free}}
+}
+
+func TestRemediatorCooldownAndClear(t *testing.T) {
+	r, invoked := newTestRemediator(Policy{
+		Name:         "swap",
+		Match:        SwapExhausted(0.1),
+		Command:      Pause,
+		ClearCommand: Resume,
+		Cooldown:     time.Minute,
+	})
+	now := time.Now()
+
+	r.evaluate([]Status{swapStatus("a", 5), swapStatus("b", 50)}, now)
+	r.evaluate([]Status{swapStatus("a", 5)}, now.Add(time.Second))
+	r.evaluate([]Status{swapStatus("a", 50)}, now.Add(2*time.Second))
+	r.evaluate([]Status{swapStatus("a", 50)}, now.Add(3*time.Second))
+
+	want := []invocation{{Pause, "a"}, {Resume, "a"}}
+	if len(*invoked) != len(want) {
+		t.Fatalf("invoked = %v, want %v", *invoked, want)
+	}
+	for i := range want {
+		if (*invoked)[i] != want[i] {
+			t.Errorf("invoked[%d] = %v, want %v", i, (*invoked)[i], want[i])
+		}
+	}
+}
+
+func TestRemediatorRateLimit(t *testing.T) {
+	r, invoked := newTestRemediator(Policy{
+		Name:       "old tasks",
+		Match:      TasksOlderThan(time.Minute),
+		Command:    KillTask,
+		MaxActions: 2,
+		Window:     time.Hour,
+	})
+	old := time.Now().Add(-time.Hour)
+	st := Status{
+		Name:      "a",
+		Tasks:     []string{"t1", "t2", "t3", "t4"},
+		TaskStart: map[string]time.Time{"t1": old, "t2": old, "t3": old, "t4": time.Now()},
+	}
+
+	r.evaluate([]Status{st}, time.Now())
+	if len(*invoked) != 2 {
+		t.Errorf("len(invoked) = %d, want 2", len(*invoked))
+	}
+	for _, inv := range *invoked {
+		if inv.cmd != KillTask || inv.target == "t4" {
+			t.Errorf("unexpected invocation %v", inv)
+		}
+	}
+}
+
+func TestRemediatorRateLimitWithoutWindow(t *testing.T) {
+	r, invoked := newTestRemediator(Policy{
+		Name:       "swap",
+		Match:      SwapExhausted(0.1),
+		Command:    Pause,
+		MaxActions: 1,
+	})
+	now := time.Now()
+	r.evaluate([]Status{swapStatus("a", 5)}, now)
+	r.evaluate([]Status{swapStatus("b", 5)}, now.Add(24*time.Hour))
+	if len(*invoked) != 1 {
+		t.Errorf("invoked = %v, want a single invocation", *invoked)
+	}
+}
+
+func TestRemediatorStartStop(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	s.Beat = 0
+	r := NewRemediator(s)
+	if r.Interval != defaultRemediationInterval {
+		t.Errorf("Interval = %v, want %v", r.Interval, defaultRemediationInterval)
+	}
+	// Stop must not block if the remediator was not started.
+	r.Stop()
+	r.Stop()
+
+	evaluated := make(chan bool, 1)
+	heartbeat(t, s, Status{Name: "a"})
+	r = NewRemediator(s)
+	r.Interval = time.Millisecond
+	r.Policies = []Policy{{Name: "probe", Match: func(st Status) []string {
+		select {
+		case evaluated <- true:
+		default:
+		}
+		return nil
+	}}}
+	r.Start()
+	select {
+	case <-evaluated:
+	case <-time.After(time.Second):
+		t.Error("policies not evaluated")
+	}
+	r.Stop()
+}
+
+func TestRemediatorDryRunAndKillSwitch(t *testing.T) {
+	p := Policy{Name: "swap", Match: SwapExhausted(0.1), Command: Pause}
+	st := []Status{swapStatus("a", 0)}
+
+	r, invoked := newTestRemediator(p)
+	r.DryRun = true
+	r.evaluate(st, time.Now())
+	if len(*invoked) != 0 {
+		t.Errorf("dry-run invoked %v", *invoked)
+	}
+
+	r, invoked = newTestRemediator(p)
+	r.Disable()
+	r.evaluate(st, time.Now())
+	if len(*invoked) != 0 {
+		t.Errorf("disabled remediator invoked %v", *invoked)
+	}
+	r.Enable()
+	r.evaluate(st, time.Now())
+	if len(*invoked) != 1 {
+		t.Errorf("len(invoked) = %d, want 1", len(*invoked))
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+// ErrNoReply is returned by InvokeWait when no agent replies in time.
+var ErrNoReply = errors.New("no reply")
+
+// A Reply is the reply sent by an agent after executing a command.
+type Reply struct {
+	// ID is the id of the request.
+	ID string
+
+	// Agent is the identity of the agent that sent the reply. It is only
+	// set if the supervisor authenticates the agents (see
+	// Supervisor.TrustedKeys and Supervisor.TrustedCAs).
+	Agent string
+
+	// Command is the executed command. It is only set if Err is empty.
+	Command Command
+
+	// Data contains the data returned by the function registered by the
+	// agent for the command.
+	Data []byte
+
+	// Err contains the error returned by the agent, if any.
+	Err string
+
+	// Refusal is set if the agent refused the command because of its
+	// CommandPolicy.
+	Refusal *Refusal
+}
+
+// InvokeWait is like InvokeArgs but it waits for the reply of the agent. If
+// no reply is received before timeout, ErrNoReply is returned. If the agent
+// replies with an error, the reply is returned along with the error, which is
+// a *Refusal if the agent refused the command.
+func (s *Supervisor) InvokeWait(cmd Command, target string, args []byte, timeout time.Duration) (Reply, error) {
+	return s.invokeWait(envelope{Cmd: cmd, Target: target, Args: args}, timeout)
+}
+
+// InvokeConfirmWait is like InvokeConfirm but it waits for the reply of the
+// agent like InvokeWait.
+func (s *Supervisor) InvokeConfirmWait(cmd Command, target string, args []byte, token string, timeout time.Duration) (Reply, error) {
+	return s.invokeWait(envelope{Cmd: cmd, Target: target, Args: args, Confirm: token}, timeout)
+}
+
+// SendWait is like Send but it waits for the reply of the agent like
+// InvokeWait.
+func (s *Supervisor) SendWait(inv Invocation, timeout time.Duration) (Reply, error) {
+	return s.invokeWait(inv.envelope(), timeout)
+}
+
+func (s *Supervisor) invokeWait(e envelope, timeout time.Duration) (Reply, error) {
+	// Replies are not delivered until the request is registered as
+	// pending.
+	s.pmu.Lock()
+	id, err := s.invoke(e)
+	if err != nil {
+		s.pmu.Unlock()
+		return Reply{}, err
+	}
+	ch := make(chan Reply, 1)
+	s.pending[id] = ch
+	s.pmu.Unlock()
+
+	defer func() {
+		s.pmu.Lock()
+		delete(s.pending, id)
+		s.pmu.Unlock()
+	}()
+
+	select {
+	case r := <-ch:
+		if r.Refusal != nil {
+			return r, r.Refusal
+		}
+		if r.Err != "" {
+			return r, errors.New(r.Err)
+		}
+		return r, nil
+	case <-time.After(timeout):
+		return Reply{ID: id}, ErrNoReply
+	}
+}
+
+// deliver sends the result to the InvokeWait call waiting for it, if any,
+// and to s.Replies. agent is the identity of the agent that sent it.
+func (s *Supervisor) deliver(r rpcmq.Result, agent string) {
+	reply := Reply{ID: r.UUID, Agent: agent, Err: r.Err}
+	if refusal, ok := parseRefusal(r.Err); ok {
+		reply.Refusal, reply.Err = refusal, refusal.Error()
+	}
+	if r.Err == "" && len(r.Data) > 0 {
+		reply.Command, reply.Data = Command(r.Data[0]), r.Data[1:]
+	}
+	s.auditReply(reply)
+	if reply.Err != "" || reply.Command != GetStatus {
+		s.events.emit(Event{Type: EventReply, Reply: &reply})
+		if s.Replies != nil {
+			go func() {
+				s.Replies <- reply
+			}()
+		}
+	}
+
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+
+	if ch, ok := s.pending[r.UUID]; ok {
+		select {
+		case ch <- reply:
+		default:
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	// ErrUnsigned is returned by the agents when they receive an unsigned
+	// command and signatures are required.
+	ErrUnsigned = errors.New("unsigned command")
+
+	// ErrUnknownKey is returned by the agents when a command is signed
+	// with a key that is not trusted.
+	ErrUnknownKey = errors.New("unknown signing key")
+
+	// ErrBadSignature is returned by the agents when the signature of a
+	// command is not valid.
+	ErrBadSignature = errors.New("bad signature")
+)
+
+// A Signer signs the commands sent by a supervisor.
+type Signer interface {
+	// KeyID returns the identifier of the key, which allows the agents to
+	// select the key to verify the signature.
+	KeyID() string
+
+	// Sign returns the signature of msg.
+	Sign(msg []byte) ([]byte, error)
+}
+
+// A Verifier verifies the signature of the commands received by an agent.
+type Verifier interface {
+	// KeyID returns the identifier of the key.
+	KeyID() string
+
+	// Verify returns ErrBadSignature if sig is not a valid signature of
+	// msg.
+	Verify(msg, sig []byte) error
+}
+
+// HMACKey is a shared key used to sign and verify commands with HMAC-SHA256.
+// It implements both Signer and Verifier.
+type HMACKey struct {
+	ID     string
+	Secret []byte
+}
+
+// KeyID returns k.ID.
+func (k HMACKey) KeyID() string {
+	return k.ID
+}
+
+// Sign returns the HMAC-SHA256 of msg.
+func (k HMACKey) Sign(msg []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+// Verify checks that sig is the HMAC-SHA256 of msg.
+func (k HMACKey) Verify(msg, sig []byte) error {
+	expected, _ := k.Sign(msg)
+	if !hmac.Equal(sig, expected) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Ed25519Signer signs commands with an Ed25519 private key.
+type Ed25519Signer struct {
+	ID  string
+	Key ed25519.PrivateKey
+}
+
+// KeyID returns s.ID.
+func (s Ed25519Signer) KeyID() string {
+	return s.ID
+}
+
+// Sign returns the Ed25519 signature of msg.
+func (s Ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	if len(s.Key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid Ed25519 private key")
+	}
+	return ed25519.Sign(s.Key, msg), nil
+}
+
+// Ed25519Verifier verifies commands with an Ed25519 public key.
+type Ed25519Verifier struct {
+	ID  string
+	Key ed25519.PublicKey
+}
+
+// KeyID returns v.ID.
+func (v Ed25519Verifier) KeyID() string {
+	return v.ID
+}
+
+// Verify checks the Ed25519 signature of msg.
+func (v Ed25519Verifier) Verify(msg, sig []byte) error {
+	if len(v.Key) != ed25519.PublicKeySize || !ed25519.Verify(v.Key, msg, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// LoadSigner returns a Signer with the given key id and the key stored in the
+// file at path. If the file contains a PEM encoded PKCS #8 Ed25519 private
+// key, an Ed25519Signer is returned. Otherwise, the content of the file,
+// without trailing spaces, is the secret of an HMACKey.
+func LoadSigner(path, id string) (Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return HMACKey{ID: id, Secret: bytes.TrimSpace(b)}, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return Ed25519Signer{ID: id, Key: priv}, nil
+}
+
+// LoadVerifier returns a Verifier with the given key id and the key stored in
+// the file at path. If the file contains a PEM encoded PKIX Ed25519 public
+// key, an Ed25519Verifier is returned. Otherwise, the content of the file,
+// without trailing spaces, is the secret of an HMACKey, as in LoadSigner.
+func LoadVerifier(path, id string) (Verifier, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return HMACKey{ID: id, Secret: bytes.TrimSpace(b)}, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return Ed25519Verifier{ID: id, Key: pub}, nil
+}
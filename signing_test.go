@@ -0,0 +1,207 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAgent returns a running agent that counts the calls to PauseFunc.
+// The agent goes back to running after every Pause, so it can be invoked
+// repeatedly.
+func newTestAgent(name string, calls *int) *Agent {
+	a := NewAgent("", "", name)
+	a.status.State = Running
+	a.PauseFunc = func(data []byte) ([]byte, error) {
+		*calls++
+		return nil, nil
+	}
+	a.TransitionFunc = func(from, to State) {
+		if to == Paused {
+			a.restore(Running)
+		}
+	}
+	return a
+}
+
+func TestSignedCommands(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := HMACKey{ID: "shared", Secret: []byte("secret")}
+
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.TrustedKeys = []Verifier{hmacKey, Ed25519Verifier{ID: "ops", Key: pub}}
+
+	tests := []struct {
+		signer  Signer
+		wantErr error
+	}{
+		{hmacKey, nil},
+		{Ed25519Signer{ID: "ops", Key: priv}, nil},
+		{nil, ErrUnsigned},
+		{Ed25519Signer{ID: "ops", Key: otherPriv}, ErrBadSignature},
+		{HMACKey{ID: "shared", Secret: []byte("guess")}, ErrBadSignature},
+		{HMACKey{ID: "other", Secret: []byte("secret")}, ErrUnknownKey},
+	}
+	for i, tt := range tests {
+		s := NewSupervisor("", "", "")
+		s.Signer = tt.signer
+		data, err := s.encodeRequest(Pause, "w1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls = 0
+		_, err = a.invoke("id", data)
+		switch {
+		case tt.wantErr == nil && err != nil:
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		case tt.wantErr != nil && (err == nil || !strings.Contains(err.Error(), tt.wantErr.Error())):
+			t.Errorf("test %d: error = %v, want %v", i, err, tt.wantErr)
+		case (tt.wantErr == nil) != (calls == 1):
+			t.Errorf("test %d: PauseFunc called %d times", i, calls)
+		}
+	}
+}
+
+func TestTamperedCommand(t *testing.T) {
+	key := HMACKey{ID: "shared", Secret: []byte("secret")}
+	s := NewSupervisor("", "", "")
+	s.Signer = key
+	data, err := s.encodeRequest(Pause, "w1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), `"w1"`, `"w2"`, 1))
+
+	var calls int
+	a := newTestAgent("w2", &calls)
+	a.TrustedKeys = []Verifier{key}
+	if _, err := a.invoke("id", data); err == nil || calls != 0 {
+		t.Errorf("tampered command accepted")
+	}
+}
+
+func TestUnsignedStatus(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	a.TrustedKeys = []Verifier{HMACKey{ID: "shared", Secret: []byte("secret")}}
+	data := encodeInvocation(GetStatus, "", nil)
+
+	if _, err := a.invoke("id", data); err == nil {
+		t.Error("unsigned GetStatus accepted")
+	}
+	a.AllowUnsignedStatus = true
+	if _, err := a.invoke("id", data); err != nil {
+		t.Errorf("unsigned GetStatus rejected: %v", err)
+	}
+}
+
+func TestReplayedCommand(t *testing.T) {
+	key := HMACKey{ID: "shared", Secret: []byte("secret")}
+	s := NewSupervisor("", "", "")
+	s.Signer = key
+	data, err := s.encodeRequest(Pause, "w1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.TrustedKeys = []Verifier{key}
+	if _, err := a.invoke("id", data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.invoke("id", data); err == nil || !strings.Contains(err.Error(), ErrReplayed.Error()) {
+		t.Errorf("replayed command: error = %v, want %v", err, ErrReplayed)
+	}
+	if calls != 1 {
+		t.Errorf("PauseFunc called %d times, want 1", calls)
+	}
+}
+
+func TestExpiredCommand(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		e       envelope
+		maxAge  time.Duration
+		expired bool
+	}{
+		{envelope{IssuedAt: now.Add(-time.Second), TTL: time.Minute}, 0, false},
+		{envelope{IssuedAt: now.Add(-2 * time.Minute), TTL: time.Minute}, 0, true},
+		{envelope{IssuedAt: now.Add(-2 * time.Minute)}, 0, false},
+		{envelope{IssuedAt: now.Add(-2 * time.Minute)}, time.Minute, true},
+		{envelope{IssuedAt: now.Add(-2 * time.Minute), TTL: time.Hour}, time.Minute, true},
+		{envelope{IssuedAt: now.Add(time.Hour)}, 0, true},
+		{envelope{}, 0, true},
+	}
+	for i, tt := range tests {
+		if got := tt.e.expired(now, tt.maxAge, time.Second); got != tt.expired {
+			t.Errorf("test %d: expired = %v, want %v", i, got, tt.expired)
+		}
+	}
+
+	s := NewSupervisor("", "", "")
+	s.CommandTTL = time.Nanosecond
+	data, err := s.encodeRequest(Pause, "w1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	a := newTestAgent("w1", &calls)
+	a.ClockSkew = 0
+	time.Sleep(time.Millisecond)
+	if _, err := a.invoke("id", data); err == nil || !strings.Contains(err.Error(), ErrExpired.Error()) {
+		t.Errorf("expired command: error = %v, want %v", err, ErrExpired)
+	}
+	if calls != 0 {
+		t.Errorf("PauseFunc called %d times, want 0", calls)
+	}
+}
+
+func TestCommandForOtherAgent(t *testing.T) {
+	var calls int
+	records := 0
+	a := newTestAgent("w2", &calls)
+	a.TrustedKeys = []Verifier{HMACKey{ID: "w2-ops", Secret: []byte("other")}}
+	a.Audit = AuditFunc(func(r AuditRecord) error {
+		records++
+		return nil
+	})
+
+	s := NewSupervisor("", "", "")
+	s.Signer = HMACKey{ID: "w1-ops", Secret: []byte("secret")}
+	data, err := s.encodeRequest(Pause, "w1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Agents that cannot verify a command do not reply to it unless it is
+	// for them.
+	if reply, err := a.invoke("id", data); reply != nil || err != nil {
+		t.Errorf("command for w1: invoke = %q, %v, want no reply", reply, err)
+	}
+	if records != 0 {
+		t.Errorf("%d audit records for a command for another agent", records)
+	}
+
+	if data, err = s.encodeRequest(Pause, "w2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.invoke("id", data); err == nil || !strings.Contains(err.Error(), ErrUnknownKey.Error()) {
+		t.Errorf("command for w2: error = %v, want %v", err, ErrUnknownKey)
+	}
+	if calls != 0 || records != 1 {
+		t.Errorf("calls = %d, records = %d", calls, records)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidTransition is returned when an agent is asked to change to a
+// state that cannot be reached from its current state.
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// State is the lifecycle state of an agent.
+type State string
+
+const (
+	// Starting is the state of an agent until Init succeeds.
+	Starting State = "starting"
+
+	// Running is the state of an agent that is accepting work.
+	Running State = "running"
+
+	// Pausing is the state of an agent while PauseFunc is executed.
+	Pausing State = "pausing"
+
+	// Paused is the state of an agent after a Pause command.
+	Paused State = "paused"
+
+	// Draining is the state of an agent after a SoftShutdown command,
+	// until its registered tasks finish.
+	Draining State = "draining"
+
+	// Stopping is the state of an agent while HardShutdownFunc is
+	// executed.
+	Stopping State = "stopping"
+
+	// Stopped is the final state of an agent.
+	Stopped State = "stopped"
+)
+
+// transitions holds the states that can be reached from every state.
+var transitions = map[State][]State{
+	Starting: {Running, Stopping, Stopped},
+	Running:  {Pausing, Draining, Stopping, Stopped},
+	Pausing:  {Paused, Stopping, Stopped},
+	Paused:   {Running, Draining, Stopping, Stopped},
+	Draining: {Stopping, Stopped},
+	Stopping: {Stopped},
+	Stopped:  {},
+}
+
+// A commandTransition describes how a command changes the state of an agent.
+// The agent must be in one of the states from. If during is not empty, the
+// agent is in that state while the function registered for the command is
+// executed. If the function succeeds, the agent changes to the state after,
+// if any; otherwise, it goes back to the previous state.
+type commandTransition struct {
+	from   []State
+	during State
+	after  State
+}
+
+var commandTransitions = map[Command]commandTransition{
+	Pause:        {from: []State{Running}, during: Pausing, after: Paused},
+	Resume:       {from: []State{Paused}, after: Running},
+	SoftShutdown: {from: []State{Running, Paused}, during: Draining},
+	HardShutdown: {during: Stopping, after: Stopped},
+}
+
+// CanTransition reports whether an agent in state from can change to state
+// to.
+func CanTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// A TransitionFunc is called after an agent changes its state.
+type TransitionFunc func(from, to State)
+
+// State returns the current lifecycle state of the agent.
+func (a *Agent) State() State {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.status.State
+}
+
+// SetState changes the lifecycle state of the agent. It returns an error
+// wrapping ErrInvalidTransition if the state cannot be reached from the
+// current one.
+func (a *Agent) SetState(to State) error {
+	_, err := a.transition(nil, to)
+	return err
+}
+
+// transition changes the state of the agent to the state to. If from is not
+// nil, the current state must be one of them. It returns the previous state.
+func (a *Agent) transition(from []State, to State) (State, error) {
+	a.mu.Lock()
+	cur := a.status.State
+	err := checkTransition(cur, from, to)
+	if err == nil {
+		a.setState(to)
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		return cur, err
+	}
+	a.notify()
+	if a.TransitionFunc != nil {
+		a.TransitionFunc(cur, to)
+	}
+	return cur, nil
+}
+
+// setState changes the state of the agent and wakes up the goroutines waiting
+// for it to change. The caller must hold a.mu.
+func (a *Agent) setState(s State) {
+	a.status.State = s
+	a.status.StateSince = time.Now()
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// restore changes the state of the agent back to a previous state, without
+// checking the transition table.
+func (a *Agent) restore(prev State) {
+	a.mu.Lock()
+	cur := a.status.State
+	a.setState(prev)
+	a.mu.Unlock()
+
+	a.notify()
+	if a.TransitionFunc != nil {
+		a.TransitionFunc(cur, prev)
+	}
+}
+
+// beginCommand changes the state of the agent as required before executing
+// cmd. The returned function must be called with the error returned by the
+// function registered for the command, in order to complete the transition.
+func (a *Agent) beginCommand(cmd Command) (func(err error), error) {
+	t, ok := commandTransitions[cmd]
+	if !ok {
+		return func(error) {}, nil
+	}
+	if t.during == "" {
+		a.mu.RLock()
+		cur := a.status.State
+		a.mu.RUnlock()
+		if err := checkTransition(cur, t.from, t.after); err != nil {
+			return nil, err
+		}
+		return func(err error) {
+			if err != nil {
+				return
+			}
+			if _, err := a.transition(t.from, t.after); err != nil {
+				logf("%v: %v", cmd, err)
+			}
+		}, nil
+	}
+	prev, err := a.transition(t.from, t.during)
+	if err != nil {
+		return nil, err
+	}
+	return func(err error) {
+		if err != nil {
+			a.restore(prev)
+			return
+		}
+		if t.after == "" {
+			return
+		}
+		if _, err := a.transition([]State{t.during}, t.after); err != nil {
+			logf("%v: %v", cmd, err)
+		}
+	}, nil
+}
+
+func checkTransition(cur State, from []State, to State) error {
+	valid := from == nil
+	for _, s := range from {
+		if s == cur {
+			valid = true
+			break
+		}
+	}
+	if !valid || !CanTransition(cur, to) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, cur, to)
+	}
+	return nil
+}
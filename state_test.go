@@ -0,0 +1,99 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentLifecycle(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	if a.State() != Starting {
+		t.Fatalf("initial state = %s, want %s", a.State(), Starting)
+	}
+	if err := a.SetState(Running); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	a.TransitionFunc = func(from, to State) {
+		seen = append(seen, string(from)+">"+string(to))
+	}
+	var during State
+	hook := func(data []byte) ([]byte, error) {
+		during = a.State()
+		return nil, nil
+	}
+	pauseErr := errors.New("cannot pause")
+	failPause := true
+	a.PauseFunc = func(data []byte) ([]byte, error) {
+		during = a.State()
+		if failPause {
+			return nil, pauseErr
+		}
+		return nil, nil
+	}
+	a.ResumeFunc, a.SoftShutdownFunc = hook, hook
+
+	tests := []struct {
+		cmd     Command
+		wantErr string
+		during  State
+		after   State
+	}{
+		{Resume, ErrInvalidTransition.Error(), "", Running},
+		{Pause, pauseErr.Error(), Pausing, Running},
+		{Pause, "", Pausing, Paused},
+		{Pause, ErrInvalidTransition.Error(), "", Paused},
+		{Resume, "", Paused, Running},
+		{SoftShutdown, "", Draining, Stopped},
+		{Resume, ErrInvalidTransition.Error(), "", Stopped},
+	}
+	for i, tt := range tests {
+		if i == 2 {
+			failPause = false
+		}
+		during = ""
+		_, err := a.invoke("id", encodeInvocation(tt.cmd, "w1", nil))
+		if tt.cmd == SoftShutdown {
+			// There are no tasks to drain.
+			select {
+			case <-a.Drained():
+			case <-time.After(time.Second):
+				t.Fatal("drain not completed")
+			}
+		}
+		if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("test %d: %v: error = %v, want %q", i, tt.cmd, err, tt.wantErr)
+		}
+		if during != tt.during || a.State() != tt.after {
+			t.Errorf("test %d: %v: state = %s during and %s after, want %s and %s",
+				i, tt.cmd, during, a.State(), tt.during, tt.after)
+		}
+	}
+
+	want := "running>pausing,pausing>running,running>pausing,pausing>paused," +
+		"paused>running,running>draining,draining>stopped"
+	if got := strings.Join(seen, ","); got != want {
+		t.Errorf("transitions = %s, want %s", got, want)
+	}
+	if a.status.StateSince.IsZero() {
+		t.Error("StateSince not set")
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	for from := range transitions {
+		if from != Stopped && !CanTransition(from, Stopped) {
+			t.Errorf("%s cannot be stopped", from)
+		}
+		if CanTransition(Stopped, from) {
+			t.Errorf("stopped agent can change to %s", from)
+		}
+	}
+}
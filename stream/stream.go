@@ -0,0 +1,217 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package stream pushes the events of a monmq supervisor to browser clients
+using Server-Sent Events or WebSocket.
+
+Every event is sent as a JSON encoded monmq.Event. Clients can select the
+events they are interested in with the following query parameters, which can
+be repeated:
+
+	agent   name of the agent
+	label   label selector (key=value)
+	type    event type (online, status, health, offline, reset or reply)
+
+Events that do not refer to an agent (e.g. replies) are filtered out when
+agent or label filters are used.
+
+After a reconnection, clients can resume the stream using the "since" query
+parameter or, in the case of Server-Sent Events, the Last-Event-ID header.
+If the requested events are no longer kept by the supervisor, a reset event
+is sent first, whatever the filters. Clients must then fetch the current
+status of the agents again, as some events were lost.
+*/
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/monmq"
+)
+
+// Source is the interface that must be implemented by the source of the
+// events. It is satisfied by *monmq.Supervisor.
+type Source interface {
+	Subscribe(since uint64) (<-chan monmq.Event, func())
+}
+
+// Filter selects events.
+type Filter struct {
+	Agents []string
+	Labels map[string]string
+	Types  []monmq.EventType
+}
+
+// Match reports whether the event e is selected by the filter. Reset events
+// are always selected.
+func (f Filter) Match(e monmq.Event) bool {
+	if e.Type == monmq.EventReset {
+		return true
+	}
+	if len(f.Types) > 0 && !containsType(f.Types, e.Type) {
+		return false
+	}
+	if len(f.Agents) == 0 && len(f.Labels) == 0 {
+		return true
+	}
+	if e.Agent == "" {
+		return false
+	}
+	if len(f.Agents) > 0 && !contains(f.Agents, e.Agent) {
+		return false
+	}
+	for k, v := range f.Labels {
+		if e.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRequest returns the filter and the sequence number to resume from
+// specified in the request r.
+func parseRequest(r *http.Request) (Filter, uint64, error) {
+	q := r.URL.Query()
+	f := Filter{Agents: q["agent"], Labels: map[string]string{}}
+	for _, t := range q["type"] {
+		f.Types = append(f.Types, monmq.EventType(t))
+	}
+	for _, l := range q["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return Filter{}, 0, fmt.Errorf("invalid label filter %q", l)
+		}
+		f.Labels[kv[0]] = kv[1]
+	}
+
+	since := q.Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	if since == "" {
+		return f, 0, nil
+	}
+	seq, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return Filter{}, 0, fmt.Errorf("invalid sequence number %q", since)
+	}
+	return f, seq, nil
+}
+
+// SSEHandler returns a http.Handler that streams the events of src using
+// Server-Sent Events. The id of every message is the sequence number of the
+// event.
+func SSEHandler(src Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, since, err := parseRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, cancel := src.Subscribe(since)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if !f.Match(e) {
+					continue
+				}
+				b, err := json.Marshal(e)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, b); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// WebSocketHandler returns a http.Handler that streams the events of src over
+// WebSocket. Every event is sent in a text message.
+//
+// Browsers allow any page to open WebSocket connections to any site, so
+// checkOrigin must return true only for the requests whose Origin header is
+// trusted. If it is nil, only the requests whose Origin matches the Host
+// header, and the ones without Origin, are accepted.
+func WebSocketHandler(src Source, checkOrigin func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, since, err := parseRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ws, err := upgrade(w, r, checkOrigin)
+		if err != nil {
+			return
+		}
+		defer ws.close()
+
+		events, cancel := src.Subscribe(since)
+		defer cancel()
+
+		for {
+			select {
+			case <-ws.closed:
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if !f.Match(e) {
+					continue
+				}
+				b, err := json.Marshal(e)
+				if err != nil {
+					return
+				}
+				if err := ws.writeText(b); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsType(s []monmq.EventType, t monmq.EventType) bool {
+	for _, e := range s {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jroimartin/monmq"
+)
+
+var _ Source = (*monmq.Supervisor)(nil)
+
+// fakeSource replays a fixed list of events.
+type fakeSource struct {
+	events []monmq.Event
+}
+
+func (s fakeSource) Subscribe(since uint64) (<-chan monmq.Event, func()) {
+	ch := make(chan monmq.Event, len(s.events))
+	for _, e := range s.events {
+		if e.Seq > since {
+			ch <- e
+		}
+	}
+	return ch, func() {}
+}
+
+var testEvents = fakeSource{[]monmq.Event{
+	{Seq: 1, Type: monmq.EventOnline, Agent: "w1", Labels: map[string]string{"role": "crawler"}},
+	{Seq: 2, Type: monmq.EventOnline, Agent: "x1", Labels: map[string]string{"role": "indexer"}},
+	{Seq: 3, Type: monmq.EventReply, Reply: &monmq.Reply{ID: "id"}},
+	{Seq: 4, Type: monmq.EventStatus, Agent: "w1", Labels: map[string]string{"role": "crawler"}},
+	{Seq: 5, Type: monmq.EventOffline, Agent: "x1", Labels: map[string]string{"role": "indexer"}},
+}}
+
+func TestFilterReset(t *testing.T) {
+	r := httptest.NewRequest("GET", "/?agent=x1&label=role=crawler&type=status", nil)
+	f, _, err := parseRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match(monmq.Event{Seq: 1, Type: monmq.EventReset}) {
+		t.Error("reset event filtered out")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []uint64
+	}{
+		{"", []uint64{1, 2, 3, 4, 5}},
+		{"agent=x1", []uint64{2, 5}},
+		{"label=role=crawler", []uint64{1, 4}},
+		{"type=online&type=reply", []uint64{1, 2, 3}},
+		{"type=status&agent=x1", nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+		f, _, err := parseRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, e := range testEvents.events {
+			if f.Match(e) {
+				got = append(got, e.Seq)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: matched %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: matched %v, want %v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	ts := httptest.NewServer(SSEHandler(testEvents))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/?agent=w1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+	var lines []string
+	for i := 0; i < 3; i++ {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(l))
+	}
+	if lines[0] != "id: 4" || lines[1] != "event: status" || !strings.HasPrefix(lines[2], "data: {") {
+		t.Errorf("unexpected message %q", lines)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	ts := httptest.NewServer(WebSocketHandler(testEvents, nil))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /?since=2&type=offline HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status code = %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", accept)
+	}
+
+	ws := &wsConn{conn: conn, rw: bufio.NewReadWriter(br, bufio.NewWriter(conn))}
+	op, payload, err := ws.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != opText {
+		t.Fatalf("opcode = %d, want %d", op, opText)
+	}
+	var e monmq.Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Seq != 5 || e.Type != monmq.EventOffline {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	handshake := func(h http.Handler, origin string) int {
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		if origin == "self" {
+			origin = ts.URL
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	trusted := func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://dashboard.example.com"
+	}
+	tests := []struct {
+		checkOrigin func(r *http.Request) bool
+		origin      string
+		wantCode    int
+	}{
+		{nil, "", http.StatusSwitchingProtocols},
+		{nil, "self", http.StatusSwitchingProtocols},
+		{nil, "https://evil.example.com", http.StatusForbidden},
+		{trusted, "https://dashboard.example.com", http.StatusSwitchingProtocols},
+		{trusted, "self", http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		if code := handshake(WebSocketHandler(testEvents, tt.checkOrigin), tt.origin); code != tt.wantCode {
+			t.Errorf("test %d: origin %q: status code = %d, want %d", i, tt.origin, code, tt.wantCode)
+		}
+	}
+}
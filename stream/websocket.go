@@ -0,0 +1,205 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// This file implements the subset of RFC 6455 needed to push messages to the
+// clients: the opening handshake, unfragmented text frames sent by the server
+// and the closing handshake.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+type wsConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	closed chan bool
+
+	wmu sync.Mutex // guards writes
+}
+
+// upgrade performs the opening handshake. The request is refused if
+// checkOrigin returns false or, if checkOrigin is nil, if it is not
+// same-origin (see sameOrigin). If the handshake fails, an error response is
+// sent to the client.
+func upgrade(w http.ResponseWriter, r *http.Request, checkOrigin func(r *http.Request) bool) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket handshake expected", http.StatusBadRequest)
+		return nil, errors.New("bad handshake")
+	}
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, errors.New("origin not allowed")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &wsConn{conn: conn, rw: rw, closed: make(chan bool)}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// readLoop discards the messages sent by the client, answering pings and
+// closing the connection when a close frame is received or the connection
+// fails.
+func (ws *wsConn) readLoop() {
+	defer close(ws.closed)
+	for {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch op {
+		case opClose:
+			ws.writeFrame(opClose, nil)
+			return
+		case opPing:
+			ws.writeFrame(opPong, payload)
+		}
+	}
+}
+
+func (ws *wsConn) readFrame() (op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.rw, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op = hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("frame too large")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}
+
+func (ws *wsConn) writeText(b []byte) error {
+	return ws.writeFrame(opText, b)
+}
+
+func (ws *wsConn) writeFrame(op byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	hdr := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		hdr = append(append(hdr, 127), ext[:]...)
+	}
+	if _, err := ws.rw.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+func (ws *wsConn) close() {
+	ws.writeFrame(opClose, nil)
+	ws.conn.Close()
+}
+
+// sameOrigin reports whether the Origin header of the request, if any,
+// matches its Host header. Requests without Origin are not sent by browsers,
+// thus they are allowed.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
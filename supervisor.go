@@ -5,10 +5,13 @@
 package monmq
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,16 +31,62 @@ const (
 	Resume
 	KillTask
 	CustomCmd
+	GetLogs
 )
 
+var commandNames = []string{
+	GetStatus:    "GetStatus",
+	SoftShutdown: "SoftShutdown",
+	HardShutdown: "HardShutdown",
+	Pause:        "Pause",
+	Resume:       "Resume",
+	KillTask:     "KillTask",
+	CustomCmd:    "CustomCmd",
+	GetLogs:      "GetLogs",
+}
+
+// ParseCommand returns the command with the given name. The comparison is
+// case-insensitive.
+func ParseCommand(name string) (Command, error) {
+	for i, n := range commandNames {
+		if strings.EqualFold(n, name) {
+			return Command(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown command %q", name)
+}
+
+func (c Command) String() string {
+	if int(c) < len(commandNames) {
+		return commandNames[c]
+	}
+	return fmt.Sprintf("Command(%d)", c)
+}
+
 // A Supervisor is responsible for requesting information from the deployed
 // agents and sending control commands to these agents.
 type Supervisor struct {
+	uri  string
 	c    *rpcmq.Client
+	ps   *rpcmq.Server
 	done chan bool
+	stop sync.Once
 
-	mu     sync.RWMutex
-	status []Status
+	mu      sync.RWMutex
+	status  []Status
+	tasks   map[string]TaskInfo
+	history map[string][]Status
+
+	pmu     sync.Mutex
+	pending map[string]chan Reply
+
+	amu     sync.Mutex
+	invoked map[string]AuditRecord // invocations waiting for a reply
+
+	rmu     sync.Mutex
+	replies map[string]time.Time // signed replies received, see checkReply
+
+	events *eventHub
 
 	// TLSConfig allows to configure the TLS parameters used to connect to
 	// the broker via amqps.
@@ -47,9 +96,65 @@ type Supervisor struct {
 	// considering an agent as offline. Default: 5s.
 	Timeout time.Duration
 
-	// Beat allows to establish the time between heartbeats. Default: 500ms
+	// Beat allows to establish the time between heartbeats. A value lower
+	// than or equal to zero disables polling, which is useful when the
+	// agents push their status. Default: 500ms
 	Beat time.Duration
 
+	// StatusExchange is the name of the exchange where the agents push
+	// their status (see Agent.PushInterval). If it is empty, the
+	// supervisor does not listen for pushed status.
+	StatusExchange string
+
+	// HistorySize is the number of status updates kept for every online
+	// agent. Default: 60.
+	HistorySize int
+
+	// Signer, if not nil, is used to sign the commands sent to the
+	// agents.
+	Signer Signer
+
+	// TrustedKeys and TrustedCAs are used to authenticate the agents. If
+	// any of them is set, the replies and the pushed status must be
+	// signed (see Agent.Signer) with one of the keys or with a certificate
+	// issued by one of the CAs, and agents can only report the status of
+	// the identity in their key id or certificate.
+	TrustedKeys []Verifier
+	TrustedCAs  *x509.CertPool
+
+	// MaxReplyAge is the maximum difference between the time at which a
+	// signed reply or pushed status was issued by an agent and the time
+	// at which it is received, including the difference between their
+	// clocks. Older replies are refused in order to prevent replays.
+	// Default: 1m.
+	MaxReplyAge time.Duration
+
+	// CommandTTL is the amount of time during which the commands sent by
+	// the supervisor are valid. Agents refuse the commands received after
+	// their TTL. A value lower than or equal to zero means that commands
+	// do not expire, although agents may still enforce a maximum age (see
+	// Agent.MaxCommandAge).
+	CommandTTL time.Duration
+
+	// Keyring, if not nil, is used to encrypt the commands sent to the
+	// agents and to decrypt their replies, so the broker only sees
+	// ciphertext. Errors returned by the agents are not encrypted.
+	Keyring *Keyring
+
+	// Audit, if not nil, records every command invoked by the supervisor
+	// and the replies sent by the agents.
+	Audit AuditSink
+
+	// AuditWindow is the amount of time during which the replies to a
+	// command are recorded along with the command in the audit trail.
+	// Later replies are not recorded. If CommandTTL is longer, it is
+	// used instead. Default: 10m.
+	AuditWindow time.Duration
+
+	// Replies, if not nil, receives the replies sent by the agents after
+	// executing a command.
+	Replies chan Reply
+
 	// CustomResults allows the supervisor to get the results returned by
 	// agents when CustomCmd is invoked.
 	CustomResults chan []byte
@@ -58,10 +163,33 @@ type Supervisor struct {
 // Status represents the the information obtained from agents.
 type Status struct {
 	Name     string
-	Running  bool
+	Labels   map[string]string
 	Tasks    []string
 	Info     SystemInfo
+	Seq      uint64
 	LastBeat time.Time // filled by the supervisor
+
+	// State is the lifecycle state of the agent and StateSince the time at
+	// which it changed to that state.
+	State      State
+	StateSince time.Time
+
+	// Drain reports the progress of the drain after a SoftShutdown
+	// command.
+	Drain *DrainStatus `json:",omitempty"`
+
+	// Health is the worst result of the health checks of the agent and
+	// HealthChecks the result of every check (see Agent.AddHealthCheck).
+	// They are empty if the agent has no health checks.
+	Health       Health                       `json:",omitempty"`
+	HealthChecks map[string]HealthCheckResult `json:",omitempty"`
+
+	// TaskStart holds the time at which each task was registered.
+	TaskStart map[string]time.Time
+
+	// Metrics holds the custom metrics set by the agent (see
+	// Agent.SetMetric).
+	Metrics map[string]float64
 }
 
 // NewSupervisor returns a reference to a Supervisor object. The paremeter uri
@@ -70,11 +198,22 @@ type Status struct {
 // will be created.
 func NewSupervisor(uri, repliesQueue, exchange string) *Supervisor {
 	s := &Supervisor{
+		uri:     uri,
 		status:  []Status{},
+		tasks:   map[string]TaskInfo{},
+		history: map[string][]Status{},
+		pending: map[string]chan Reply{},
+		invoked: map[string]AuditRecord{},
+		replies: map[string]time.Time{},
+		events:  newEventHub(eventBuffer),
 		c:       rpcmq.NewClient(uri, "", repliesQueue, exchange, "fanout"),
 		done:    make(chan bool),
 		Timeout: 30 * time.Second,
 		Beat:    5 * time.Second,
+
+		HistorySize: 60,
+		AuditWindow: 10 * time.Minute,
+		MaxReplyAge: time.Minute,
 	}
 	return s
 }
@@ -86,7 +225,19 @@ func (s *Supervisor) Init() error {
 	if err := s.c.Init(); err != nil {
 		return err
 	}
-	go s.sendHeartbeat()
+	if s.StatusExchange != "" {
+		s.ps = rpcmq.NewServer(s.uri, "", s.StatusExchange, "fanout")
+		s.ps.TLSConfig = s.TLSConfig
+		if err := s.ps.Register("status", s.pushedStatus); err != nil {
+			return err
+		}
+		if err := s.ps.Init(); err != nil {
+			return err
+		}
+	}
+	if s.Beat > 0 {
+		go s.sendHeartbeat()
+	}
 	go s.getResponses()
 	return nil
 }
@@ -97,7 +248,16 @@ func (s *Supervisor) sendHeartbeat() {
 		case <-s.done:
 			return
 		case <-time.After(s.Beat):
-			data := []byte{byte(GetStatus)}
+			acks, err := s.acks()
+			if err != nil {
+				logf("GetStatus: %v", err)
+				continue
+			}
+			data, err := s.encodeRequest(GetStatus, "", acks)
+			if err != nil {
+				logf("GetStatus: %v", err)
+				continue
+			}
 			if _, err := s.c.Call("invoke", data, s.Timeout); err != nil {
 				logf("GetStatus: %v", err)
 			}
@@ -105,6 +265,19 @@ func (s *Supervisor) sendHeartbeat() {
 	}
 }
 
+// acks returns the JSON encoded sequence numbers of the last update received
+// from every online agent, which allows them to send delta updates.
+func (s *Supervisor) acks() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	acks := make(map[string]uint64)
+	for _, st := range s.status {
+		acks[st.Name] = st.Seq
+	}
+	return json.Marshal(acks)
+}
+
 func (s *Supervisor) getResponses() {
 	results := s.c.Results()
 	for {
@@ -116,14 +289,69 @@ func (s *Supervisor) getResponses() {
 				logf("route: %v", err)
 			}
 		case <-time.After(s.Timeout):
-			s.mu.Lock()
-			s.status = []Status{}
-			s.mu.Unlock()
+			s.prune()
 		}
 	}
 }
 
+// pushedStatus handles the status pushed by the agents to the status
+// exchange.
+func (s *Supervisor) pushedStatus(id string, data []byte) ([]byte, error) {
+	if err := s.handleResult(rpcmq.Result{UUID: id, Data: data}, true); err != nil {
+		logf("route: %v", err)
+	}
+	return nil, nil
+}
+
+// prune removes the agents that have not sent their status during the last
+// s.Timeout.
+func (s *Supervisor) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alive := []Status{}
+	for _, st := range s.status {
+		if time.Since(st.LastBeat) <= s.Timeout {
+			alive = append(alive, st)
+		}
+	}
+	s.setStatus(alive)
+}
+
+// route handles the reply of an agent to a request.
 func (s *Supervisor) route(r rpcmq.Result) error {
+	return s.handleResult(r, false)
+}
+
+// handleResult handles a reply of an agent or, if pushed is true, a status
+// pushed by an agent.
+func (s *Supervisor) handleResult(r rpcmq.Result, pushed bool) error {
+	if r.Err == "" && len(r.Data) == 0 {
+		// The command was not for the agent that replied.
+		return nil
+	}
+	if isSealed(r.Data) {
+		if s.Keyring == nil {
+			return ErrNoKey
+		}
+		data, err := s.Keyring.open(r.Data, adReply)
+		if err != nil {
+			return err
+		}
+		r.Data = data
+	}
+	var agent string
+	if len(r.Data) > 0 && s.authenticatesAgents() {
+		sr, err := verifyReply(r.Data, s.TrustedKeys, s.TrustedCAs)
+		if err != nil {
+			return err
+		}
+		if err := s.checkReply(sr, r.UUID, pushed); err != nil {
+			return err
+		}
+		r.Data, agent = sr.Data, sr.KeyID
+	}
+	s.deliver(r, agent)
 	if r.Err != "" {
 		return errors.New(r.Err)
 	}
@@ -136,6 +364,11 @@ func (s *Supervisor) route(r rpcmq.Result) error {
 	switch cmd {
 	case GetStatus:
 		logf("GetStatus response")
+		if s.authenticatesAgents() {
+			if err := checkStatusName(data, agent); err != nil {
+				return err
+			}
+		}
 		err = s.handleGetStatus(data)
 	case SoftShutdown:
 		logf("SoftShutdown response")
@@ -147,6 +380,8 @@ func (s *Supervisor) route(r rpcmq.Result) error {
 		logf("Resume response")
 	case KillTask:
 		logf("KillTask response")
+	case GetLogs:
+		logf("GetLogs response")
 	case CustomCmd:
 		logf("CustomCmd response")
 		go func() {
@@ -158,15 +393,74 @@ func (s *Supervisor) route(r rpcmq.Result) error {
 	return err
 }
 
+// checkReply returns an error if the signed reply does not belong to the
+// request with the given id, was issued more than MaxReplyAge ago or has
+// already been received. Pushed status do not belong to any request.
+func (s *Supervisor) checkReply(r signedReply, id string, pushed bool) error {
+	if r.ID == "" || (!pushed && r.ID != id) {
+		return ErrReplayed
+	}
+	now := time.Now()
+	if age := now.Sub(r.IssuedAt); age > s.MaxReplyAge || age < -s.MaxReplyAge {
+		return ErrExpired
+	}
+
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for key, exp := range s.replies {
+		if now.After(exp) {
+			delete(s.replies, key)
+		}
+	}
+	// Every agent replies to the same request, so the ids are only
+	// unique per agent.
+	key := r.KeyID + "\x00" + r.ID
+	if _, ok := s.replies[key]; ok {
+		return ErrReplayed
+	}
+	s.replies[key] = r.IssuedAt.Add(s.MaxReplyAge)
+	return nil
+}
+
+// authenticatesAgents reports whether the replies of the agents must be
+// signed.
+func (s *Supervisor) authenticatesAgents() bool {
+	return len(s.TrustedKeys) > 0 || s.TrustedCAs != nil
+}
+
+// checkStatusName returns ErrIdentityMismatch if the status update, either a
+// snapshot or a delta, was not reported by the agent with the given identity.
+func checkStatusName(data []byte, identity string) error {
+	var st struct{ Name string }
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	if st.Name != identity {
+		return ErrIdentityMismatch
+	}
+	return nil
+}
+
 func (s *Supervisor) handleGetStatus(data []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if isDelta(data) {
+		var err error
+		if data, err = s.applyDelta(data); err != nil {
+			return err
+		}
+	}
 	status := Status{}
 	if err := json.Unmarshal(data, &status); err != nil {
 		return err
 	}
 	status.LastBeat = time.Now()
+	s.history[status.Name] = append(s.history[status.Name], status)
+	if n := len(s.history[status.Name]) - s.HistorySize; n > 0 {
+		s.history[status.Name] = s.history[status.Name][n:]
+	}
 	alive := []Status{status}
 	for _, st := range s.status {
 		if st.Name == status.Name || time.Since(st.LastBeat) > s.Timeout {
@@ -174,34 +468,215 @@ func (s *Supervisor) handleGetStatus(data []byte) error {
 		}
 		alive = append(alive, st)
 	}
-	s.status = alive
+	s.setStatus(alive)
 	return nil
 }
 
+// applyDelta returns the JSON encoded status resulting of applying the given
+// delta update to the last status received from the agent. The caller must
+// hold s.mu.
+func (s *Supervisor) applyDelta(data []byte) ([]byte, error) {
+	var d statusDelta
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	for _, st := range s.status {
+		if st.Name != d.Name {
+			continue
+		}
+		if st.Seq != d.Base {
+			break
+		}
+		old, err := json.Marshal(st)
+		if err != nil {
+			return nil, err
+		}
+		return applyDelta(old, d)
+	}
+	return nil, errDeltaBase
+}
+
+// setStatus replaces the status of the online agents and rebuilds the task
+// index. The caller must hold s.mu.
+func (s *Supervisor) setStatus(status []Status) {
+	tasks := make(map[string]TaskInfo)
+	now := time.Now()
+	for _, st := range status {
+		for _, id := range st.Tasks {
+			ti := TaskInfo{ID: id, Agent: st.Name, Start: st.TaskStart[id]}
+			if ti.Start.IsZero() {
+				// Agent not reporting start times, use the first
+				// time the task was seen.
+				if prev, ok := s.tasks[id]; ok && prev.Agent == st.Name {
+					ti.Start = prev.Start
+				} else {
+					ti.Start = now
+				}
+			}
+			tasks[id] = ti
+		}
+	}
+	for name := range s.history {
+		online := false
+		for _, st := range status {
+			if st.Name == name {
+				online = true
+				break
+			}
+		}
+		if !online {
+			delete(s.history, name)
+		}
+	}
+	s.emitStatusEvents(s.status, status)
+	s.status = status
+	s.tasks = tasks
+}
+
 // Shutdown shuts down the supervisor gracefully. Using this method will ensure
 // that all replies sent by the agents to the supervisor will be received by
 // the latter.
+// Calling Shutdown more than once has no effect.
 func (s *Supervisor) Shutdown() {
-	s.done <- true // Heartbeats
-	s.done <- true // Responses
-	s.c.Shutdown()
+	s.stop.Do(func() {
+		close(s.done)
+		if s.ps != nil {
+			s.ps.Shutdown()
+		}
+		s.c.Shutdown()
+	})
 }
 
-// Status returns the status of all the online agents.
+// Status returns the status of all the online agents. The returned slice is
+// a copy, so it can be modified (e.g. sorted) by the caller.
 func (s *Supervisor) Status() []Status {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return s.status
+	status := make([]Status, len(s.status))
+	copy(status, s.status)
+	return status
+}
+
+// History returns the last status updates received from the given agent,
+// oldest first. See HistorySize.
+func (s *Supervisor) History(name string) []Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]Status(nil), s.history[name]...)
 }
 
 // Invoke invokes the given command on the corresponding worker or task. The
 // target is selected by name in the case of the workers or by uuid in the case
-// of the tasks.
+// of the tasks. KillTask returns ErrTaskNotFound if the task was not reported
+// by any online agent.
 func (s *Supervisor) Invoke(cmd Command, target string) error {
-	data := fmt.Sprintf("%c%s", cmd, target)
-	if _, err := s.c.Call("invoke", []byte(data), 0); err != nil {
-		return err
+	_, err := s.InvokeArgs(cmd, target, nil)
+	return err
+}
+
+// InvokeArgs is like Invoke but it also sends args to the function registered
+// by the agent for the command (see InvocationArgs). It returns the id of the
+// request.
+func (s *Supervisor) InvokeArgs(cmd Command, target string, args []byte) (string, error) {
+	return s.invoke(envelope{Cmd: cmd, Target: target, Args: args})
+}
+
+// InvokeConfirm is like InvokeArgs but it also sends the token that confirms
+// a command refused by an agent because its CommandPolicy requires a
+// confirmation (see Refusal.ConfirmToken). The command, target and args must
+// be the same of the refused invocation.
+func (s *Supervisor) InvokeConfirm(cmd Command, target string, args []byte, token string) (string, error) {
+	return s.invoke(envelope{Cmd: cmd, Target: target, Args: args, Confirm: token})
+}
+
+// An Invocation describes a command invoked with Send or SendWait.
+type Invocation struct {
+	Command Command
+	Target  string
+	Args    []byte
+
+	// Confirm is the token that confirms a command refused by an agent
+	// (see InvokeConfirm).
+	Confirm string
+
+	// Issuer is the identity on whose behalf the command is invoked (e.g.
+	// the user of a management tool). It is only recorded in the audit
+	// trail. If it is empty, the key id of Signer is recorded.
+	Issuer string
+}
+
+// Send is like InvokeArgs but takes all the parameters of the invocation
+// from inv. It returns the id of the request.
+func (s *Supervisor) Send(inv Invocation) (string, error) {
+	return s.invoke(inv.envelope())
+}
+
+func (inv Invocation) envelope() envelope {
+	return envelope{
+		Cmd:     inv.Command,
+		Target:  inv.Target,
+		Args:    inv.Args,
+		Confirm: inv.Confirm,
+		issuer:  inv.Issuer,
 	}
-	return nil
+}
+
+func (s *Supervisor) invoke(e envelope) (string, error) {
+	if e.Cmd == KillTask {
+		if _, err := s.FindTask(e.Target); err != nil {
+			return "", err
+		}
+	}
+	data, err := s.encodeEnvelope(e)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.c.Call("invoke", data, s.CommandTTL)
+	if err != nil {
+		return "", err
+	}
+	s.auditInvoke(AuditRecord{
+		ID:      id,
+		Issuer:  e.issuer,
+		Command: e.Cmd.String(),
+		Target:  e.Target,
+		Args:    e.Args,
+	})
+	return id, nil
+}
+
+// encodeInvocation returns the data sent to the agents to invoke cmd on
+// target.
+func encodeInvocation(cmd Command, target string, args []byte) []byte {
+	data := []byte{byte(cmd)}
+	data = append(data, target...)
+	if len(args) > 0 {
+		data = append(data, sep)
+		data = append(data, args...)
+	}
+	return data
+}
+
+// InvocationArgs returns the arguments contained in the data passed to a
+// CommandFunction, or nil if the supervisor did not send any.
+func InvocationArgs(data []byte) []byte {
+	_, _, args, err := decodeInvocation(data)
+	if err != nil {
+		return nil
+	}
+	return args
+}
+
+// decodeInvocation is the inverse of encodeInvocation.
+func decodeInvocation(data []byte) (cmd Command, target string, args []byte, err error) {
+	if len(data) < 1 {
+		return 0, "", nil, errors.New("malformed request")
+	}
+	cmd, aux := Command(data[0]), data[1:]
+	if i := bytes.IndexByte(aux, sep); i >= 0 {
+		return cmd, string(aux[:i]), aux[i+1:], nil
+	}
+	return cmd, string(aux), nil, nil
 }
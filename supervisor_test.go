@@ -0,0 +1,166 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+func TestInvocationEncoding(t *testing.T) {
+	tests := []struct {
+		cmd    Command
+		target string
+		args   []byte
+	}{
+		{GetStatus, "", nil},
+		{GetStatus, "", []byte(`{"a":1}`)},
+		{Pause, "worker-1", nil},
+		{CustomCmd, "worker-1", []byte("x|y")},
+	}
+	for _, tt := range tests {
+		data := encodeInvocation(tt.cmd, tt.target, tt.args)
+		cmd, target, args, err := decodeInvocation(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd != tt.cmd || target != tt.target || !bytes.Equal(args, tt.args) {
+			t.Errorf("decodeInvocation(%q) = %v, %q, %q", data, cmd, target, args)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	for i := range commandNames {
+		cmd := Command(i)
+		got, err := ParseCommand(cmd.String())
+		if err != nil || got != cmd {
+			t.Errorf("ParseCommand(%q) = %v, %v", cmd.String(), got, err)
+		}
+	}
+	if _, err := ParseCommand("hardshutdown"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseCommand("Explode"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestStatusCopy(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	heartbeat(t, s, Status{Name: "b", Seq: 1})
+	heartbeat(t, s, Status{Name: "a", Seq: 1})
+
+	status := s.Status()
+	status[0], status[1] = status[1], status[0]
+	status[0].Name = "changed"
+	for _, st := range s.Status() {
+		if st.Name == "changed" {
+			t.Fatal("Status returned the internal slice")
+		}
+	}
+}
+
+func TestCommandFunctionData(t *testing.T) {
+	a := NewAgent("", "", "worker-1")
+	var got [][]byte
+	a.CustomFunc = func(data []byte) ([]byte, error) {
+		got = append(got, data)
+		return nil, nil
+	}
+	for _, args := range []string{"", "x|y"} {
+		if _, err := a.invoke("id", encodeInvocation(CustomCmd, "worker-1", []byte(args))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The functions receive the raw invocation, as they always did.
+	if string(got[0]) != string(rune(CustomCmd))+"worker-1" {
+		t.Errorf("CustomFunc data = %q, want the command and the target", got[0])
+	}
+	if args := InvocationArgs(got[1]); string(args) != "x|y" {
+		t.Errorf("InvocationArgs(%q) = %q, want %q", got[1], args, "x|y")
+	}
+	if args := InvocationArgs(got[0]); args != nil {
+		t.Errorf("InvocationArgs(%q) = %q, want nil", got[0], args)
+	}
+	if a.Name() != "worker-1" {
+		t.Errorf("Name = %q", a.Name())
+	}
+}
+
+func TestPushedStatus(t *testing.T) {
+	key := HMACKey{ID: "w1", Secret: []byte("secret")}
+	a := NewAgent("", "", "w1")
+	a.Signer = key
+	a.DeltaUpdates = true
+	s := NewSupervisor("", "", "")
+	s.TrustedKeys = []Verifier{key}
+
+	var last []byte
+	for i := 0; i < 4; i++ {
+		if i == 1 {
+			a.RegisterTask("t1")
+		}
+		data, seq, err := a.pushUpdate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr, err := verifyReply(data, s.TrustedKeys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta := isDelta(sr.Data[1:]); delta != (i > 0) {
+			t.Errorf("update %d: isDelta = %v", i, delta)
+		}
+		if i == 2 {
+			// The push failed, so the following update is based on
+			// the last one received by the supervisor.
+			continue
+		}
+		if err := s.handleResult(rpcmq.Result{UUID: "msg", Data: data}, true); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+		a.pushed, last = seq, data
+	}
+
+	status := s.Status()
+	if len(status) != 1 || status[0].Seq != 4 || !reflect.DeepEqual(status[0].Tasks, []string{"t1"}) {
+		t.Errorf("Status = %+v", status)
+	}
+
+	if err := s.handleResult(rpcmq.Result{UUID: "msg", Data: last}, true); err != ErrReplayed {
+		t.Errorf("replayed update: error = %v, want %v", err, ErrReplayed)
+	}
+	// Pushed status do not answer any request.
+	data, _, err := a.pushUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.route(rpcmq.Result{UUID: "id", Data: data}); err != ErrReplayed {
+		t.Errorf("pushed update as reply: error = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestPruneStatus(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	s.Timeout = 50 * time.Millisecond
+	heartbeat(t, s, Status{Name: "a", Seq: 1})
+	heartbeat(t, s, Status{Name: "b", Seq: 1})
+
+	s.prune()
+	if n := len(s.Status()); n != 2 {
+		t.Fatalf("len(Status) = %d after prune, want 2", n)
+	}
+	time.Sleep(2 * s.Timeout)
+	heartbeat(t, s, Status{Name: "b", Seq: 2})
+	s.prune()
+	if status := s.Status(); len(status) != 1 || status[0].Name != "b" {
+		t.Errorf("Status = %+v, want only b", status)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrTaskNotFound is returned when a task is not handled by any agent.
+var ErrTaskNotFound = errors.New("task not found")
+
+// TaskInfo describes a task handled by an agent.
+type TaskInfo struct {
+	ID    string
+	Agent string
+	Start time.Time
+}
+
+// Age returns the amount of time the task has been running.
+func (ti TaskInfo) Age() time.Duration {
+	return time.Since(ti.Start)
+}
+
+// TaskStats summarizes the tasks handled by the online agents.
+type TaskStats struct {
+	// Count is the number of tasks.
+	Count int
+
+	// Age is the distribution of the age of the tasks in seconds.
+	Age Distribution
+}
+
+// FindTask returns the information of the task with the given id. If no
+// online agent reported it in its last heartbeat, ErrTaskNotFound is
+// returned.
+func (s *Supervisor) FindTask(id string) (TaskInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ti, ok := s.tasks[id]
+	if !ok {
+		return TaskInfo{}, ErrTaskNotFound
+	}
+	return ti, nil
+}
+
+// Tasks returns the tasks handled by the online agents for which filter
+// returns true, sorted by start time. If filter is nil, all the tasks are
+// returned.
+func (s *Supervisor) Tasks(filter func(ti TaskInfo) bool) []TaskInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tasks := []TaskInfo{}
+	for _, ti := range s.tasks {
+		if filter == nil || filter(ti) {
+			tasks = append(tasks, ti)
+		}
+	}
+	sort.Sort(byStart(tasks))
+	return tasks
+}
+
+// TaskStats returns statistics about the tasks handled by the online agents.
+func (s *Supervisor) TaskStats() TaskStats {
+	tasks := s.Tasks(nil)
+	ages := make([]float64, len(tasks))
+	for i, ti := range tasks {
+		ages[i] = ti.Age().Seconds()
+	}
+	return TaskStats{Count: len(tasks), Age: distribution(ages)}
+}
+
+type byStart []TaskInfo
+
+func (t byStart) Len() int      { return len(t) }
+func (t byStart) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byStart) Less(i, j int) bool {
+	if t[i].Start.Equal(t[j].Start) {
+		return t[i].ID < t[j].ID
+	}
+	return t[i].Start.Before(t[j].Start)
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func heartbeat(t *testing.T, s *Supervisor, st Status) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.handleGetStatus(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskIndex(t *testing.T) {
+	s := NewSupervisor("", "", "")
+	start := time.Now().Add(-time.Minute)
+	heartbeat(t, s, Status{
+		Name:      "a",
+		Tasks:     []string{"t1", "t2"},
+		TaskStart: map[string]time.Time{"t1": start, "t2": start.Add(time.Second)},
+	})
+	heartbeat(t, s, Status{Name: "b", Tasks: []string{"t3"}})
+
+	ti, err := s.FindTask("t2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.Agent != "a" || !ti.Start.Equal(start.Add(time.Second)) {
+		t.Errorf("FindTask(t2) = %+v", ti)
+	}
+	if _, err := s.FindTask("t4"); err != ErrTaskNotFound {
+		t.Errorf("FindTask(t4) error = %v, want %v", err, ErrTaskNotFound)
+	}
+	if err := s.Invoke(KillTask, "t4"); err != ErrTaskNotFound {
+		t.Errorf("Invoke(KillTask, t4) error = %v, want %v", err, ErrTaskNotFound)
+	}
+
+	tasks := s.Tasks(func(ti TaskInfo) bool { return ti.Agent == "a" })
+	if len(tasks) != 2 || tasks[0].ID != "t1" || tasks[1].ID != "t2" {
+		t.Errorf("Tasks = %+v", tasks)
+	}
+
+	// t1 finished
+	heartbeat(t, s, Status{
+		Name:      "a",
+		Tasks:     []string{"t2"},
+		TaskStart: map[string]time.Time{"t2": start.Add(time.Second)},
+	})
+	if _, err := s.FindTask("t1"); err != ErrTaskNotFound {
+		t.Errorf("FindTask(t1) error = %v, want %v", err, ErrTaskNotFound)
+	}
+
+	stats := s.TaskStats()
+	if stats.Count != 2 {
+		t.Errorf("TaskStats.Count = %d, want 2", stats.Count)
+	}
+	if stats.Age.Max < time.Minute.Seconds()-1 {
+		t.Errorf("TaskStats.Age.Max = %f", stats.Age.Max)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/jroimartin/rpcmq"
+)
+
+var (
+	// ErrPaused is returned by the functions wrapped by Agent.Wrap when
+	// the agent is paused and HoldWhenPaused is false.
+	ErrPaused = errors.New("agent paused")
+
+	// ErrNotAccepting is returned by the functions wrapped by Agent.Wrap
+	// when the agent is draining or stopped.
+	ErrNotAccepting = errors.New("agent not accepting work")
+)
+
+// Custom metrics set by the functions wrapped by Agent.Wrap.
+const (
+	MetricTasksCompleted   = "tasks.completed"
+	MetricTasksFailed      = "tasks.failed"
+	MetricTasksPanicked    = "tasks.panicked"
+	MetricTasksRejected    = "tasks.rejected"
+	MetricTaskDuration     = "tasks.last_duration_seconds"
+	MetricTasksDurationSum = "tasks.duration_seconds_total"
+)
+
+// A TaskDoneFunc is called when a function wrapped by Agent.Wrap returns. d is
+// the duration of the task and err the error it returned, if any.
+type TaskDoneFunc func(id string, d time.Duration, err error)
+
+// Wrap returns an rpcmq function that registers the task while f is executed
+// (see RegisterTask) and removes it afterwards. f can get the context of the
+// task, which is cancelled by KillTask, with TaskContext. Panics in f are recovered
+// and returned as errors. The duration and outcome of the tasks are reported
+// as custom metrics and to TaskDoneFunc.
+//
+// New tasks are rejected with ErrNotAccepting when the agent is draining or
+// stopped. When the agent is paused, they are rejected with ErrPaused or, if
+// HoldWhenPaused is true, held until the agent is resumed.
+func (a *Agent) Wrap(f rpcmq.Function) rpcmq.Function {
+	return func(id string, data []byte) (b []byte, err error) {
+		if err := a.admit(); err != nil {
+			a.mu.Lock()
+			a.addMetric(MetricTasksRejected, 1)
+			a.mu.Unlock()
+			return nil, err
+		}
+
+		a.RegisterTask(id)
+		start := time.Now()
+		defer func() {
+			if r := recover(); r != nil {
+				logf("task %s panicked: %v\n%s", id, r, debug.Stack())
+				a.mu.Lock()
+				a.addMetric(MetricTasksPanicked, 1)
+				a.mu.Unlock()
+				b, err = nil, fmt.Errorf("panic: %v", r)
+			}
+			d := time.Since(start)
+			if err := a.RemoveTask(id); err != nil {
+				logf("task %s: %v", id, err)
+			}
+			a.taskDone(id, d, err)
+		}()
+		return f(id, data)
+	}
+}
+
+// admit waits until the agent can accept new work. It returns an error if the
+// work must be rejected.
+func (a *Agent) admit() error {
+	for {
+		a.mu.RLock()
+		state, changed := a.status.State, a.changed
+		a.mu.RUnlock()
+
+		switch state {
+		case Starting, Running:
+			return nil
+		case Pausing, Paused:
+			if !a.HoldWhenPaused {
+				return ErrPaused
+			}
+			<-changed
+		default:
+			return ErrNotAccepting
+		}
+	}
+}
+
+func (a *Agent) taskDone(id string, d time.Duration, err error) {
+	a.mu.Lock()
+	if err != nil {
+		a.addMetric(MetricTasksFailed, 1)
+	} else {
+		a.addMetric(MetricTasksCompleted, 1)
+	}
+	a.setMetric(MetricTaskDuration, d.Seconds())
+	a.addMetric(MetricTasksDurationSum, d.Seconds())
+	a.mu.Unlock()
+
+	if a.TaskDoneFunc != nil {
+		a.TaskDoneFunc(id, d, err)
+	}
+}
+
+// addMetric adds delta to the value of a custom metric. The caller must hold
+// a.mu.
+func (a *Agent) addMetric(name string, delta float64) {
+	a.setMetric(name, a.status.Metrics[name]+delta)
+}
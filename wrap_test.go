@@ -0,0 +1,93 @@
+// Copyright 2015 The monmq Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monmq
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrap(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	a.status.State = Running
+	var done []string
+	a.TaskDoneFunc = func(id string, d time.Duration, err error) {
+		done = append(done, id)
+	}
+
+	f := a.Wrap(func(id string, data []byte) ([]byte, error) {
+		if !a.ownsTask(id) {
+			t.Errorf("task %s not registered", id)
+		}
+		switch string(data) {
+		case "fail":
+			return nil, errors.New("failed")
+		case "panic":
+			panic("boom")
+		}
+		return data, nil
+	})
+
+	if b, err := f("t1", []byte("ok")); err != nil || string(b) != "ok" {
+		t.Errorf("f = %q, %v", b, err)
+	}
+	if _, err := f("t2", []byte("fail")); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := f("t3", []byte("panic")); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("panic error = %v", err)
+	}
+
+	if len(a.status.Tasks) != 0 {
+		t.Errorf("Tasks = %v, want none", a.status.Tasks)
+	}
+	if strings.Join(done, ",") != "t1,t2,t3" {
+		t.Errorf("done tasks = %v", done)
+	}
+	m := a.status.Metrics
+	if m[MetricTasksCompleted] != 1 || m[MetricTasksFailed] != 2 || m[MetricTasksPanicked] != 1 {
+		t.Errorf("Metrics = %v", m)
+	}
+}
+
+func TestWrapPaused(t *testing.T) {
+	a := NewAgent("", "", "w1")
+	a.status.State = Paused
+	f := a.Wrap(func(id string, data []byte) ([]byte, error) {
+		return data, nil
+	})
+
+	if _, err := f("t1", nil); err != ErrPaused {
+		t.Errorf("error = %v, want %v", err, ErrPaused)
+	}
+
+	a.HoldWhenPaused = true
+	errc := make(chan error)
+	go func() {
+		_, err := f("t2", nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("task not held: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := a.SetState(Running); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("held task: %v", err)
+	}
+
+	a.status.State = Draining
+	if _, err := f("t3", nil); err != ErrNotAccepting {
+		t.Errorf("error = %v, want %v", err, ErrNotAccepting)
+	}
+	if a.status.Metrics[MetricTasksRejected] != 2 {
+		t.Errorf("Metrics = %v", a.status.Metrics)
+	}
+}